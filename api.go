@@ -0,0 +1,235 @@
+package main
+
+import (
+	"database/sql"; "log"; "strconv"; "strings"; "time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/limiter"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// The built-in JSON API, enabled by API=true. Every endpoint uses the database of the request's tier,
+// so only the nodes served to the visitor are listed.
+const apiPrefix = "/_api"
+
+// A node in the API responses. The links and the metadata are only given in the node endpoint.
+type apiNode struct {
+	File string `json:"file"`
+	Url string `json:"url"`
+	Title string `json:"title"`
+	Date int64 `json:"date"`
+	Params map[string]any `json:"params,omitempty"`
+	Outlinks []string `json:"outlinks,omitempty"`
+	Backlinks []string `json:"backlinks,omitempty"`
+	Attachments []string `json:"attachments,omitempty"`
+	Match string `json:"match,omitempty"` // The matched part of the content in the search results.
+}
+
+// If the request is for the API or the suggestions. They are limited like the nodes.
+func isApiRequest(urlPath string) bool {
+	return urlPath == apiPrefix || strings.HasPrefix(urlPath, apiPrefix+"/") || urlPath == suggestPath
+}
+
+// The rate limiter of the JSON endpoints at the path. If the limit is not given as [expiration seconds, max requests], there is no limiter.
+func apiLimiter(urlPath string, limit []int) (handlers []fiber.Handler) {
+	if len(limit) != 2 {return nil}
+	log.Println("Rate limit is applied for:", urlPath)
+	return append(handlers, limiter.New(limiter.Config{
+		Expiration: time.Duration(limit[0])*time.Second, Max: limit[1],
+		KeyGenerator: func(c *fiber.Ctx) string { return c.IP() },
+		LimitReached: func(c *fiber.Ctx) error {return apiError(c, fiber.StatusTooManyRequests)},
+	}))
+}
+
+// Register the API endpoints. If the limit is given as [expiration seconds, max requests], the API is rate limited with it.
+func initApiRoutes(app *fiber.App, limit []int) {
+	api := app.Group(apiPrefix, apiLimiter(apiPrefix, limit)...)
+
+	api.Get("/nodes", apiNodes)
+	api.Get("/nodes/*", apiNodeDetails)
+	api.Get("/tags", apiTags)
+	api.Get("/search", apiSearch)
+	api.All("/*", func(c *fiber.Ctx) error {return apiError(c, fiber.StatusNotFound)})
+}
+
+// Respond with the status and its message as a JSON error.
+func apiError(c *fiber.Ctx, status int) error {
+	return c.Status(status).JSON(fiber.Map{"error": utils.StatusMessage(status)})
+}
+
+// Get the integer query value, limited between min and max. If it is not given or invalid, the default is used.
+func queryInt(c *fiber.Ctx, key string, def, minimum, maximum int) int {
+	value, err := strconv.Atoi(c.Query(key))
+	if err != nil {return def}
+	return max(minimum, min(value, maximum))
+}
+
+// Parse the date query value as a unix time or a YYYY-MM-DD date.
+func queryDate(c *fiber.Ctx, key string) (int64, bool) {
+	value := c.Query(key)
+	if value == "" {return 0, false}
+	if unix, err := strconv.ParseInt(value, 10, 64); err == nil {return unix, true}
+	if date, err := time.Parse(time.DateOnly, value); err == nil {return date.Unix(), true}
+	return 0, false
+}
+
+// List the nodes, newest first.
+// Query values: limit, offset, from and to (unix time or YYYY-MM-DD), and param (key or key:value, can be repeated)
+func apiNodes(c *fiber.Ctx) error {
+	var where []string
+	var vals []any
+
+	for _,param := range c.Context().QueryArgs().PeekMulti("param") {
+		key, value, hasValue := strings.Cut(string(param), ":")
+		if hasValue {
+			where = append(where, `EXISTS (SELECT 1 FROM params p WHERE p."from" = n.file AND p.key = ? AND p.value IN (?, ?))`)
+			vals = append(vals, key, value, typedParamValue(value))
+		} else {
+			where = append(where, `EXISTS (SELECT 1 FROM params p WHERE p."from" = n.file AND p.key = ?)`)
+			vals = append(vals, key)
+		}
+	}
+	for key, condition := range map[string]string{"from": "n.date >= ?", "to": "n.date <= ?"} {
+		if c.Query(key) == "" {continue}
+		date, ok := queryDate(c, key)
+		if !ok {return apiError(c, fiber.StatusBadRequest)}
+		where = append(where, condition); vals = append(vals, date)
+	}
+	whereStr := ""
+	if len(where) != 0 { whereStr = " WHERE "+strings.Join(where, " AND ") }
+
+	tier := getTier(c)
+	var total int
+	if err := tier.DB.QueryRow(`SELECT COUNT(*) FROM nodes n`+whereStr, vals...).Scan(&total); err != nil {
+		log.Println("API error:", err); return apiError(c, fiber.StatusInternalServerError)
+	}
+
+	limit := queryInt(c, "limit", 50, 1, 500); offset := queryInt(c, "offset", 0, 0, total)
+	rows, err := tier.DB.Query(`SELECT n.file, n.title, n.date FROM nodes n`+whereStr+` ORDER BY n.date DESC, n.file LIMIT ? OFFSET ?`, append(vals, limit, offset)...)
+	if err != nil {log.Println("API error:", err); return apiError(c, fiber.StatusInternalServerError)}
+	nodes, err := scanApiNodes(rows)
+	if err != nil {log.Println("API error:", err); return apiError(c, fiber.StatusInternalServerError)}
+
+	return c.JSON(fiber.Map{"total": total, "limit": limit, "offset": offset, "nodes": nodes})
+}
+
+// Get the metadata, the links and the attachments of the node, like /_api/nodes/folder/note.md
+func apiNodeDetails(c *fiber.Ctx) error {
+	tier := getTier(c)
+	nodePath := "/"+c.Params("*")
+
+	var node apiNode
+	var title sql.NullString; var date sql.NullInt64
+	err := tier.DB.QueryRow(`SELECT file, title, date FROM nodes WHERE file = ?`, nodePath).Scan(&node.File, &title, &date)
+	if err == sql.ErrNoRows {
+		if err := tier.tombstoneStmt.QueryRow(nodePath).Scan(&title); err == nil {return apiError(c, fiber.StatusGone)}
+		return apiError(c, fiber.StatusNotFound)
+	}
+	if err != nil {log.Println("API error:", err); return apiError(c, fiber.StatusInternalServerError)}
+	node.Url, node.Title, node.Date = PrettyUrl(node.File), title.String, date.Int64
+
+	// The metadata is read from the node, so the values keep their types.
+	nodeInfo, exists := tier.nodeCache.Get(nodePath)
+	if !exists {
+		nodeInfo, err = getNodeInfo(nodePath, tier.Full, false)
+		if err != nil {log.Println("API error:", err); return apiError(c, fiber.StatusInternalServerError)}
+		tier.nodeCache.Put(nodePath, nodeInfo)
+	}
+	if !tier.IsServed(&nodeInfo) {return apiError(c, fiber.StatusNotFound)}
+	node.Params = nodeInfo.Params
+
+	for _,list := range []struct{ dest *[]string; query string }{
+		{&node.Outlinks, `SELECT "to" FROM outlinks WHERE "from" = ? ORDER BY "to"`},
+		{&node.Backlinks, `SELECT "from" FROM outlinks WHERE "to" = ? ORDER BY "from"`},
+		{&node.Attachments, `SELECT file FROM attachments WHERE "from" = ? ORDER BY file`},
+	} {
+		rows, err := tier.DB.Query(list.query, nodePath)
+		if err != nil {log.Println("API error:", err); return apiError(c, fiber.StatusInternalServerError)}
+		for rows.Next() {
+			var file string
+			if err := rows.Scan(&file); err == nil { *list.dest = append(*list.dest, file) }
+		}
+		rows.Close()
+	}
+
+	return c.JSON(node)
+}
+
+// List the tags with their node counts, the most used first.
+func apiTags(c *fiber.Ctx) error {
+	rows, err := getTier(c).DB.Query(`SELECT value, COUNT(*) AS count FROM params WHERE key = 'tags' GROUP BY value ORDER BY count DESC, value`)
+	if err != nil {log.Println("API error:", err); return apiError(c, fiber.StatusInternalServerError)}
+	defer rows.Close()
+
+	type apiTag struct { Tag string `json:"tag"`; Count int `json:"count"` }
+	tags := []apiTag{}
+	for rows.Next() {
+		var tag apiTag
+		if err := rows.Scan(&tag.Tag, &tag.Count); err != nil {log.Println("API error:", err); return apiError(c, fiber.StatusInternalServerError)}
+		tags = append(tags, tag)
+	}
+	return c.JSON(tags)
+}
+
+// Search the titles and the contents of the nodes with the q query value, read by ParseSearch. CONTENT_SEARCH must be true.
+func apiSearch(c *fiber.Ctx) error {
+	if getEnvValue("CONTENT_SEARCH") != "true" {return apiError(c, fiber.StatusNotFound)}
+	q := c.Query("q")
+	search := ParseSearch(q)
+	if search.Match == "" && search.Filters == "1" {return apiError(c, fiber.StatusBadRequest)}
+	limit := queryInt(c, "limit", 20, 1, 100)
+
+	tier := getTier(c)
+	var rows *sql.Rows
+	var err error
+	if search.Match == "" {
+		// Only the filters are given, like tag:go, so the newest nodes that pass them are listed.
+		rows, err = tier.DB.Query(`SELECT n.file, n.title, n.date FROM nodes n
+			WHERE `+search.Filters+` ORDER BY n.date DESC LIMIT ?`, append(search.Values[1:], limit)...)
+	} else {
+		// The stored content gives the snippets with the stemmed and the diacritic-folded matches too.
+		matchColumn := ""
+		if ftsStoresContent() { matchColumn = `, snippet(nodes_fts, 1, '`+snippetStart+`', '`+snippetEnd+`', '...', 12)` }
+		rows, err = tier.DB.Query(`SELECT n.file, n.title, n.date`+matchColumn+`
+			FROM nodes n JOIN nodes_fts f ON n.id = f.rowid
+			WHERE nodes_fts MATCH ? AND `+search.Filters+` ORDER BY f.rank LIMIT ?`, append(search.Values, limit)...)
+	}
+	if err != nil {log.Println("API error:", err); return apiError(c, fiber.StatusInternalServerError)}
+	nodes, err := scanApiNodes(rows)
+	if err != nil {log.Println("API error:", err); return apiError(c, fiber.StatusInternalServerError)}
+
+	// The matches are HTML in both cases: the content is escaped, and only the matched parts are wrapped in <b>.
+	if ftsStoresContent() {
+		for i := range nodes { nodes[i].Match = snippetHtml(nodes[i].Match) }
+	} else if search.Match != "" {
+		for i := range nodes { nodes[i].Match = string(GetContentMatch(tier.GetNodeContent(nodes[i].File), q, 30)) }
+	}
+	return c.JSON(nodes)
+}
+
+// Convert the query value to the value stored in the params table, so param=draft:true or param=rating:5 match the typed values.
+func typedParamValue(value string) any {
+	if i, err := strconv.ParseInt(value, 10, 64); err == nil {return i}
+	if f, err := strconv.ParseFloat(value, 64); err == nil {return f}
+	if value == "true" || value == "false" {return value == "true"}
+	if date, err := time.Parse(time.DateOnly, value); err == nil {return date.Unix()}
+	return value
+}
+
+// Scan the file, title and date columns, and the match column if it is selected.
+func scanApiNodes(rows *sql.Rows) ([]apiNode, error) {
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {return nil, err}
+	nodes := []apiNode{}
+	for rows.Next() {
+		var node apiNode
+		var title sql.NullString; var date sql.NullInt64
+		dest := []any{&node.File, &title, &date}
+		if len(columns) > 3 { dest = append(dest, &node.Match) }
+		if err := rows.Scan(dest...); err != nil {return nil, err}
+		node.Url, node.Title, node.Date = PrettyUrl(node.File), title.String, date.Int64
+		nodes = append(nodes, node)
+	}
+	return nodes, rows.Err()
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"; "bytes"; "crypto/hmac"; "crypto/rand"; "crypto/sha256"; "encoding/base64"; "fmt"; "html"; "log"; "net/url"; "os"
+	"path/filepath"; "strconv"; "strings"; "time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/limiter"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The users who can log in to see the private nodes. key: username, value: bcrypt hash of the password
+var authUsers map[string][]byte
+// The key the session cookies are signed with. It is stored in the cache folder, so the sessions survive restarts.
+var sessionKey []byte
+
+const sessionCookie = "mandos_session"
+const sessionDuration = 7 * 24 * time.Hour
+
+// Read the AUTH_USERS file. Every line is a "username:bcrypt-hash" pair. Empty lines and the lines starting with # are ignored.
+// A hash can be generated with: htpasswd -nbBC 10 username password
+func readUsersFile(usersPath string) (map[string][]byte, error) {
+	data, err := os.ReadFile(usersPath); if err != nil {return nil, err}
+
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {continue}
+
+		username, hash, ok := strings.Cut(line, ":")
+		if !ok || username == "" || strings.Contains(username, "|") {return nil, fmt.Errorf("%s:%d: malformed user line", usersPath, lineNum)}
+		if _,err := bcrypt.Cost([]byte(hash)); err != nil {return nil, fmt.Errorf("%s:%d: %w", usersPath, lineNum, err)}
+		users[username] = []byte(hash)
+	}
+	return users, nil
+}
+
+// Load the users and the session key. The users file is validated by loadConfig, so it's okay to give fatal errors.
+func initAuth() {
+	var err error
+	authUsers, err = readUsersFile(getEnvValue("AUTH_USERS")); if err != nil {log.Fatalln(err)}
+
+	keyPath := filepath.Join(getEnvValue("CACHE_FOLDER"), "session_key")
+	sessionKey, err = os.ReadFile(keyPath)
+	if err != nil || len(sessionKey) < 32 {
+		sessionKey = make([]byte, 32)
+		if _,err := rand.Read(sessionKey); err != nil {log.Fatalln("Session key could not be generated.", err)}
+		if err := os.WriteFile(keyPath, sessionKey, 0600); err != nil {log.Fatalln("Session key could not be saved.", err)}
+	}
+	fmt.Println(len(authUsers), "user(s) can log in.")
+}
+
+func signSession(payload string) string {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Create the session cookie value for the user. It is the "username|expiry" payload and its signature.
+func newSession(username string, expires time.Time) string {
+	payload := username+"|"+strconv.FormatInt(expires.Unix(), 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(payload))+"."+signSession(payload)
+}
+
+// Get the user of the session cookie. If the cookie is invalid, expired, or the user is removed from the users file, it returns an empty string.
+func sessionUser(cookie string) string {
+	encoded, signature, ok := strings.Cut(cookie, ".")
+	if !ok {return ""}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || !hmac.Equal([]byte(signature), []byte(signSession(string(payload)))) {return ""}
+
+	i := bytes.LastIndexByte(payload, '|')
+	if i < 0 {return ""}
+	expires, err := strconv.ParseInt(string(payload[i+1:]), 10, 64)
+	if err != nil || time.Now().Unix() > expires {return ""}
+	if username := string(payload[:i]); authUsers[username] != nil {return username}
+	return ""
+}
+
+// Get the logged-in user of the request.
+func getUser(c *fiber.Ctx) string {
+	username, _ := c.Locals("user").(string)
+	return username
+}
+
+// Only allow redirecting to the local paths after logging in.
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {return "/"}
+	return next
+}
+
+// Set the tier of the logged-in users, and serve the login and logout endpoints.
+func initAuthRoutes(app *fiber.App) {
+	initAuth()
+
+	app.Use(func(c *fiber.Ctx) error {
+		username := sessionUser(c.Cookies(sessionCookie))
+		if username == "" {return c.Next()}
+
+		c.Locals("user", username); c.Locals("tier", memberTier)
+		err := c.Next()
+		// The responses of the members must not be stored by the shared caches.
+		if cacheControl := string(c.Response().Header.Peek("Cache-Control")); cacheControl == "" {
+			c.Set("Cache-Control", "private")
+		} else if !strings.Contains(cacheControl, "private") { c.Set("Cache-Control", "private, "+cacheControl) }
+		return err
+	})
+
+	// Compare with a hash even if the user does not exist, so the response time does not reveal the usernames.
+	// The comparison time depends on the cost, so the dummy hash uses the most common cost of the users.
+	costCounts := make(map[int]int)
+	dummyCost := bcrypt.DefaultCost
+	for _,hash := range authUsers { cost, _ := bcrypt.Cost(hash); costCounts[cost]++ }
+	for cost, count := range costCounts {
+		if count > costCounts[dummyCost] || (count == costCounts[dummyCost] && cost > dummyCost) { dummyCost = cost }
+	}
+	dummyHash, _ := bcrypt.GenerateFromPassword([]byte("mandos"), dummyCost)
+
+	app.Get("/_auth/login", func(c *fiber.Ctx) error {
+		c.Response().Header.Add("Content-Type", "text/html")
+		// The login.html template in the templates folder can be used to customize the login page.
+		if loginTemplate := getMdTemplate("login.html"); loginTemplate != nil {
+			buf := new(bytes.Buffer)
+			err := getTier(c).Template(loginTemplate).Execute(buf, PageVars{
+				Url: c.BaseURL()+c.OriginalURL(), Node: &Node{File: "/_auth/login", Title: "Login"}, Ctx: c, Now: time.Now().Unix(), User: getUser(c),
+			})
+			if err != nil { log.Printf("Template Error: login.html: %v", err); return sendError(c, 500, nil) }
+			return c.Send(buf.Bytes())
+		}
+
+		var message string
+		if c.Query("error") != "" { message = "<p>Wrong username or password.</p>" }
+		return c.SendString(fmt.Sprintf(`<!DOCTYPE html><html><head><meta charset="utf-8"><title>Login</title></head><body>%s
+<form method="post" action="/_auth/login"><input type="hidden" name="next" value="%s">
+<p><input name="username" placeholder="Username" autocomplete="username" required></p>
+<p><input name="password" type="password" placeholder="Password" autocomplete="current-password" required></p>
+<p><button type="submit">Log In</button></p></form></body></html>`, message, html.EscapeString(safeNext(c.Query("next")))))
+	})
+
+	loginLimit := limiter.New(limiter.Config{Expiration: time.Minute, Max: 10, KeyGenerator: func(c *fiber.Ctx) string { return c.IP() }, LimitReached: limitReached})
+	app.Post("/_auth/login", loginLimit, func(c *fiber.Ctx) error {
+		username, password, next := c.FormValue("username"), c.FormValue("password"), safeNext(c.FormValue("next"))
+
+		hash := authUsers[username]
+		if hash == nil { hash = dummyHash }
+		if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil || authUsers[username] == nil {
+			return c.Redirect("/_auth/login?error=1&next="+url.QueryEscape(next), 303)
+		}
+
+		expires := time.Now().Add(sessionDuration)
+		c.Cookie(&fiber.Cookie{
+			Name: sessionCookie, Value: newSession(username, expires), Path: "/", Expires: expires,
+			HTTPOnly: true, SameSite: fiber.CookieSameSiteLaxMode, Secure: c.Protocol() == "https",
+		})
+		log.Println("User logged in:", username, c.IP())
+		return c.Redirect(next, 303)
+	})
+
+	// Logging out is only done with POST, so the other sites cannot log the users out with links or images.
+	// The forms of the other sites are rejected by their Origin header.
+	app.Post("/_auth/logout", func(c *fiber.Ctx) error {
+		if origin := c.Get("Origin"); origin != "" {
+			if u, err := url.Parse(origin); err != nil || u.Host != string(c.Request().Host()) {return sendError(c, 403, nil)}
+		}
+		c.Cookie(&fiber.Cookie{Name: sessionCookie, Path: "/", Expires: time.Unix(0, 0), HTTPOnly: true, SameSite: fiber.CookieSameSiteLaxMode})
+		return c.Redirect("/", 303)
+	})
+}
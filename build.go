@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"; "flag"; "fmt"; "io"; "io/fs"; "log"; "os"; "path"; "path/filepath"; "strings"; "time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+)
+
+// Render every served node and solo template to the output folder, and copy the static folder and the attachments.
+// The output can be uploaded to any static file host. Usage: mandos build -o ./public -url https://example.com
+func buildStaticSite(args []string) {
+	flags := flag.NewFlagSet("build", flag.ExitOnError)
+	outDir := flags.String("o", "public", "The folder the static site will be written to.")
+	baseUrl := flags.String("url", "", "The base URL of the site. Used as the .Url variable in templates.")
+	flags.Parse(args)
+
+	out, err := filepath.Abs(*outDir); if err != nil {log.Fatalln(err)}
+	if out == notesPath || strings.HasPrefix(out, notesPath+"/") {log.Fatalln("The output folder cannot be inside MD_FOLDER:", out)}
+	if err := os.MkdirAll(out, 0755); err != nil {log.Fatalln("Output folder could not be created.", err)}
+
+	InitDB(); defer CloseDB()
+
+	fmt.Println("Folder:",notesPath); fmt.Println("Output:", out)
+
+	loadAllTemplates("md"); loadAllTemplates("solo");
+
+	initialSyncWithDB()
+
+	buildStartTime := time.Now()
+
+	// Templates can access the request context, so give them an empty GET request for the page they render.
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	newPageVars := func(urlPath string) (PageVars, func()) {
+		fctx := new(fasthttp.RequestCtx)
+		fctx.Request.Header.SetMethod(fiber.MethodGet)
+		fctx.Request.SetRequestURI(urlPath)
+		c := app.AcquireCtx(fctx)
+		return PageVars{ Url: strings.TrimSuffix(*baseUrl, "/")+urlPath, Ctx: c, Now: time.Now().Unix() }, func(){ app.ReleaseCtx(c) }
+	}
+
+	// Render the nodes. The nodes table only contains the served nodes. Only the default tier is exported, the private nodes need a login.
+	var files []string
+	rows, err := defaultTier.DB.Query(`SELECT file FROM nodes;`)
+	if err != nil {log.Fatalln(err)}
+	for rows.Next() {
+		var file string
+		if err := rows.Scan(&file); err != nil {log.Fatalln(err)}
+		files = append(files, file)
+	}
+	rows.Close()
+
+	var renderedNodes int
+	for _,file := range files {
+		nodeInfo, err := getNodeInfo(file, defaultTier.Full, false)
+		if err != nil {log.Println("Error getting node info:", file, err); continue}
+		if !defaultTier.IsServed(&nodeInfo) || nodeInfo.Content == "" {continue}
+
+		nodeTemplate := getNodeTemplate(&nodeInfo)
+		if nodeTemplate == nil {log.Println("No template found:", file); continue}
+
+		pagevars, release := newPageVars(PrettyUrl(file))
+		pagevars.Node = &nodeInfo
+		err = writeTemplateOutput(out, nodeOutputPath(file), nodeTemplate, pagevars); release()
+		if err != nil {log.Println("Template Error:", file, err); continue}
+
+		// The index page is also served at the root path.
+		if file == filepath.Join("/", indexPage) && nodeOutputPath(file) != "/index.html" {
+			copyFile(filepath.Join(out, nodeOutputPath(file)), filepath.Join(out, "index.html"))
+		}
+		renderedNodes++
+	}
+	fmt.Println(renderedNodes, "node(s) are rendered.")
+
+	// In the pretty URL mode, the folders without an index node are rendered with the listing template.
+	if listing := getMdTemplate("listing.html"); prettyUrls && listing != nil {
+		folders := make(map[string]bool)
+		for _,file := range files {
+			for dir := path.Dir(file); dir != "/"; dir = path.Dir(dir) { folders[dir+"/"] = true }
+		}
+		for folder := range folders {
+			if FileExists(folder+"index.md") {continue}
+			pagevars, release := newPageVars(folder)
+			pagevars.Node = &Node{File: folder, Title: folder}
+			if err := writeTemplateOutput(out, folder+"index.html", listing, pagevars); err != nil {log.Println("Template Error:", folder, err)}
+			release()
+		}
+	}
+
+	// Render the 404 page if it exists.
+	if notFound := getMdTemplate("404.html"); notFound != nil {
+		pagevars, release := newPageVars("/404.html")
+		pagevars.Node = &Node{File: "/404.html", Title: "404 Not Found"}; pagevars.Status = 404; pagevars.Error = "Not Found"
+		if err := writeTemplateOutput(out, "/404.html", notFound, pagevars); err != nil {log.Println("Template Error: /404.html", err)}
+		release()
+	}
+
+	// Execute the solo templates as GET requests.
+	var renderedSolos int
+	for soloPath, soloTemplate := range soloTemplates {
+		pagevars, release := newPageVars(soloPath)
+		err := writeTemplateOutput(out, soloPath, soloTemplate, pagevars); release()
+		if err != nil {log.Println("Solo template could not be rendered:", soloPath, err); continue}
+		renderedSolos++
+	}
+	fmt.Println(renderedSolos, "solo template(s) are rendered.")
+
+	// All files in the static folder are served, so copy them all.
+	staticPath := filepath.Join(notesPath, "static")
+	err = filepath.WalkDir(staticPath, func(fpath string, d fs.DirEntry, err error) error {
+		if err != nil {return err}
+		if d.IsDir() {return nil}
+		return copyFile(fpath, filepath.Join(out, strings.TrimPrefix(fpath, notesPath)))
+	})
+	if err != nil && !os.IsNotExist(err) {log.Println("Error copying the static folder:", err)}
+
+	// Copy the attachments that are linked from the served nodes.
+	var copiedAtts int
+	rows, err = defaultTier.DB.Query(`SELECT DISTINCT file FROM attachments;`)
+	if err != nil {log.Fatalln(err)}
+	defer rows.Close()
+	for rows.Next() {
+		var file string
+		if err := rows.Scan(&file); err != nil {log.Fatalln(err)}
+		absPath := SafeJoin(notesPath, file)
+		// Hidden files are never served.
+		if absPath == "" || strings.HasPrefix(filepath.Base(absPath), ".") {continue}
+		if info, err := os.Stat(absPath); err != nil || info.IsDir() {continue}
+		if err := copyFile(absPath, filepath.Join(out, file)); err != nil {log.Println("Error copying attachment:", file, err); continue}
+		copiedAtts++
+	}
+	fmt.Println(copiedAtts, "attachment(s) are copied.")
+
+	// Write the redirect rules and the aliases to a _redirects file, which is supported by many static hosts.
+	redirects, _ := os.ReadFile(filepath.Join(notesPath, getRedirectsPath()))
+	if len(redirects) != 0 && !bytes.HasSuffix(redirects, []byte("\n")) { redirects = append(redirects, '\n') }
+	for _,alias := range Query(`SELECT alias, "to" FROM aliases;`, nil) {
+		redirects = fmt.Appendf(redirects, "%s %s 301\n", alias["alias"], PrettyUrl(alias["to"].(string)))
+	}
+	if len(redirects) != 0 {
+		if err := os.WriteFile(filepath.Join(out, "_redirects"), redirects, 0644); err != nil {log.Println("Error writing the redirects:", err)}
+	}
+
+	fmt.Printf("Static site is built in %v ms\n", time.Since(buildStartTime).Milliseconds())
+}
+
+// Get the output path of the node. In the pretty URL mode, the nodes are written as HTML files,
+// so static hosts can serve /note from note.html and /folder/ from folder/index.html.
+func nodeOutputPath(file string) string {
+	if !prettyUrls {return file}
+	return strings.TrimSuffix(file, ".md")+".html"
+}
+
+// Execute the template and write the result to the urlPath inside the output folder.
+func writeTemplateOutput(out, urlPath string, templ Template, pagevars PageVars) error {
+	buf := new(bytes.Buffer)
+	if err := templ.Execute(buf, pagevars); err != nil {return err}
+	// A template can set an error status, like a not found page. Do not export it.
+	if status := pagevars.Ctx.Response().StatusCode(); status >= 400 {return fmt.Errorf("template responded with status %d", status)}
+
+	dest := filepath.Join(out, urlPath)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {return err}
+	return os.WriteFile(dest, buf.Bytes(), 0644)
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src); if err != nil {return err}
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {return err}
+	outFile, err := os.Create(dest); if err != nil {return err}
+	defer outFile.Close()
+
+	_, err = io.Copy(outFile, in)
+	return err
+}
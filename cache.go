@@ -2,9 +2,7 @@ package main
 
 import( "container/list"; "sync"; "time" )
 
-var nodeCache = NewLRUCache[string, Node](500)
-var attachmentExistenceCache = NewTTLCache[string, struct{}](5 * time.Minute)
-var queryCache = NewTTLCache[string, []map[string]any](5 * time.Minute)
+// Every tier has its own node, attachment existence and query caches. See tiers.go
 
 /////////////////////////////////////// LRU CACHE ///////////////////////////////////////
 
@@ -180,3 +178,10 @@ func (c *TTLCache[K, V]) Get(key K) (V, bool) {
 
 	return item.value, true
 }
+
+// Clear removes all the items from the cache.
+func (c *TTLCache[K, V]) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.items)
+}
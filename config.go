@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"; "errors"; "fmt"; "io"; "os"; "path/filepath"; "reflect"; "strconv"; "strings"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// The settings that can be given in the configuration file. The YAML and TOML keys are the lowercase versions of the environment variables.
+// Pointers are used to tell the unset values apart from the zero values.
+type Config struct {
+	MdFolder          string   `yaml:"md_folder" toml:"md_folder"`
+	Index             string   `yaml:"index" toml:"index"`
+	Port              *int     `yaml:"port" toml:"port"`
+	OnlyPublic        *bool    `yaml:"only_public" toml:"only_public"`
+	NoAttachmentCheck *bool    `yaml:"no_attachment_check" toml:"no_attachment_check"`
+	MdTemplates       string   `yaml:"md_templates" toml:"md_templates"`
+	SoloTemplates     []string `yaml:"solo_templates" toml:"solo_templates"`
+	ContentSearch     *bool    `yaml:"content_search" toml:"content_search"`
+	SectionSearch     *bool    `yaml:"section_search" toml:"section_search"`
+	FtsTokenizer      string   `yaml:"fts_tokenizer" toml:"fts_tokenizer"`
+	FtsWeights        []string `yaml:"fts_weights" toml:"fts_weights"`
+	FtsColumns        []string `yaml:"fts_columns" toml:"fts_columns"`
+	FtsStoreContent   *bool    `yaml:"fts_store_content" toml:"fts_store_content"`
+	CacheFolder       string   `yaml:"cache_folder" toml:"cache_folder"`
+	Cert              string   `yaml:"cert" toml:"cert"`
+	Key               string   `yaml:"key" toml:"key"`
+	BehindProxy       *bool    `yaml:"behind_proxy" toml:"behind_proxy"`
+	RateLimit         []string `yaml:"rate_limit" toml:"rate_limit"`
+	Logging           *bool    `yaml:"logging" toml:"logging"`
+	PrettyUrls        *bool    `yaml:"pretty_urls" toml:"pretty_urls"`
+	AuthUsers         string   `yaml:"auth_users" toml:"auth_users"`
+	HtmlTemplates     []string `yaml:"html_templates" toml:"html_templates"`
+	Api               *bool    `yaml:"api" toml:"api"`
+}
+
+// Values from the configuration file, converted to their environment variable form. Environment variables override them.
+var configValues = make(map[string]string)
+
+// Get the configuration file path from the -config flag or the MANDOS_CONFIG environment variable.
+// The flag is removed from os.Args, so the subcommands do not need to know about it.
+func getConfigPath() (configPath string) {
+	configPath = os.Getenv("MANDOS_CONFIG")
+	for i := 1; i < len(os.Args); i++ {
+		arg := os.Args[i]
+		if arg == "-config" || arg == "--config" {
+			if i+1 < len(os.Args) { configPath = os.Args[i+1] }
+			os.Args = append(os.Args[:i], os.Args[min(i+2, len(os.Args)):]...); break
+		}
+		if value, ok := strings.CutPrefix(arg, "-config="); ok { configPath = value; os.Args = append(os.Args[:i], os.Args[i+1:]...); break }
+		if value, ok := strings.CutPrefix(arg, "--config="); ok { configPath = value; os.Args = append(os.Args[:i], os.Args[i+1:]...); break }
+	}
+	return configPath
+}
+
+// Read the configuration file, if given, and validate every setting. All problems are reported at once in the error.
+func loadConfig() error {
+	var problems []string
+	if configPath := getConfigPath(); configPath != "" {
+		for _,problem := range readConfigFile(configPath) { problems = append(problems, configPath+": "+problem) }
+	}
+
+	problems = append(problems, validateConfig()...)
+
+	if len(problems) != 0 { return errors.New("Configuration errors:\n  - "+strings.Join(problems, "\n  - ")) }
+	return nil
+}
+
+// Read the configuration file into configValues, and return its problems. The file is read as TOML if its extension is .toml, else as YAML.
+func readConfigFile(configPath string) (problems []string) {
+	data, err := os.ReadFile(configPath); if err != nil {return []string{err.Error()}}
+
+	var config Config
+	if strings.EqualFold(filepath.Ext(configPath), ".toml") {
+		// The decoding stops at the first error, so the keys are only checked if the file is decoded.
+		if meta, err := toml.Decode(string(data), &config); err != nil { problems = append(problems, err.Error())
+		} else {
+			// Report the unknown and misspelled keys.
+			for _,key := range meta.Undecoded() { problems = append(problems, fmt.Sprintf("unknown key %q", key.String())) }
+		}
+	} else {
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true) // Report the unknown and misspelled keys.
+		// Even if there are type errors, the other fields are decoded. So they can still be validated.
+		var typeErr *yaml.TypeError
+		if err = decoder.Decode(&config); errors.As(err, &typeErr) { problems = append(problems, typeErr.Errors...)
+		} else if err != nil && !errors.Is(err, io.EOF) { problems = append(problems, err.Error()) } // io.EOF is an empty file.
+	}
+
+	configType := reflect.TypeOf(config); configVal := reflect.ValueOf(config)
+	for i := range configType.NumField() {
+		key := strings.ToUpper(configType.Field(i).Tag.Get("yaml"))
+		field := configVal.Field(i)
+
+		switch v := field.Interface().(type) {
+		case string: if v != "" { configValues[key] = v }
+		case []string: if len(v) != 0 { configValues[key] = strings.Join(v, ",") }
+		case *int: if v != nil { configValues[key] = strconv.Itoa(*v) }
+		case *bool:
+			if v == nil {continue}
+			configValues[key] = strconv.FormatBool(*v)
+			// ONLY_PUBLIC uses yes and no instead of true and false.
+			if key == "ONLY_PUBLIC" { configValues[key] = map[bool]string{true:"yes", false:"no"}[*v] }
+		}
+	}
+	return problems
+}
+
+func validateConfig() (problems []string) {
+	oneOf := func(key string, allowed ...string) {
+		value := getEnvValue(key)
+		for _,a := range allowed { if value == a {return} }
+		problems = append(problems, fmt.Sprintf("%s must be one of %q, got %q", key, allowed, value))
+	}
+	isDir := func(key string) {
+		if info, err := os.Stat(getEnvValue(key)); err != nil || !info.IsDir() {
+			problems = append(problems, fmt.Sprintf("%s must be an existing folder, got %q", key, getEnvValue(key)))
+		}
+	}
+
+	mdFolder := getEnvValue("MD_FOLDER")
+	if mdFolder == "" {
+		problems = append(problems, "MD_FOLDER must be given. Please specify the markdown folder path.")
+	} else {
+		isDir("MD_FOLDER")
+		// The default template folder is inside MD_FOLDER, so only check it if MD_FOLDER is valid.
+		if len(problems) == 0 { isDir("MD_TEMPLATES") }
+		for _,soloPath := range Split(getEnvValue("SOLO_TEMPLATES"), ",") {
+			if _,err := os.Stat(filepath.Join(mdFolder, soloPath)); err != nil { problems = append(problems, "SOLO_TEMPLATES file does not exist: "+soloPath) }
+		}
+	}
+
+	if !strings.HasSuffix(getEnvValue("INDEX"), ".md") { problems = append(problems, fmt.Sprintf("INDEX must be a markdown file, got %q", getEnvValue("INDEX"))) }
+
+	if port, err := strconv.Atoi(getEnvValue("PORT")); err != nil || port < 1 || port > 65535 {
+		problems = append(problems, fmt.Sprintf("PORT must be a number between 1 and 65535, got %q", getEnvValue("PORT")))
+	}
+
+	oneOf("ONLY_PUBLIC", "yes", "no")
+	oneOf("CONTENT_SEARCH", "true", "false")
+	oneOf("SECTION_SEARCH", "true", "false")
+	problems = append(problems, validateFtsConfig()...)
+	for _,key := range []string{"NO_ATTACHMENT_CHECK", "BEHIND_PROXY", "LOGGING", "PRETTY_URLS", "API", "FTS_STORE_CONTENT"} { oneOf(key, "", "true", "false") }
+
+	certFile, keyFile := getEnvValue("CERT"), getEnvValue("KEY")
+	if (certFile == "") != (keyFile == "") { problems = append(problems, "CERT and KEY must be given together") }
+	for _,file := range []string{certFile, keyFile} {
+		if _,err := os.Stat(file); file != "" && err != nil { problems = append(problems, "TLS file does not exist: "+file) }
+	}
+
+	for _,ext := range Split(getEnvValue("HTML_TEMPLATES"), ",") {
+		if !strings.HasPrefix(strings.TrimSpace(ext), ".") { problems = append(problems, fmt.Sprintf("HTML_TEMPLATES must be file extensions like \".html\", got %q", ext)) }
+	}
+
+	if usersFile := getEnvValue("AUTH_USERS"); usersFile != "" {
+		if _,err := readUsersFile(usersFile); err != nil { problems = append(problems, "AUTH_USERS: "+err.Error()) }
+		// The logged-in users see the private nodes, so the anonymous visitors must only see the public ones.
+		if getEnvValue("ONLY_PUBLIC") != "yes" { problems = append(problems, "ONLY_PUBLIC must be \"yes\" if AUTH_USERS is given") }
+	}
+
+	for _,limit := range Split(getEnvValue("RATE_LIMIT"), ",") {
+		parts := strings.Split(limit, ":")
+		if len(parts) != 3 { problems = append(problems, "Malformed rate limit setting: "+limit); continue }
+		for _,num := range parts[1:] {
+			if n, err := strconv.Atoi(num); err != nil || n < 1 { problems = append(problems, "Rate limit values must be positive numbers: "+limit); break }
+		}
+	}
+
+	return problems
+}
@@ -6,149 +6,126 @@ import (
 	_ "github.com/knaka/go-sqlite3-fts5"
 )
 
-var DB *sql.DB
-
-// Deleting the database files and recreating them is necessary. Because, for example:
-// getNodeInfo function extracts the outlinks and attachments based on the ONLY_PUBLIC option (using isServed function) (Some lines can be excluded). And the getNodeInfo function is used inside upsertNodes.
-// We can't use a column named "public" to determine if we are going to serve the node, because of this:
-// If its set to ONLY_PUBLIC=yes at first, links in the excluded lines are ignored in the nodes. outlinks and attachments will not contain these.
-// When its switched to ONLY_PUBLIC=no, excluded lines should not be excluded, however, we did not insert the links in the excluded lines to the database.
-// If its set to ONLY_PUBLIC=no at first, links in the excluded lines are also inserted in the outlinks and attachments tables.
-// When its switched to ONLY_PUBLIC=yes, we should exclude the links inside the excluded lines. However, they are in the table and queries will fetch them.
-func syncMarker(cacheDir, filename, envValue, disableValue string) (change bool) {
-	markerPath := filepath.Join(cacheDir, filename)
-	_, err := os.Stat(markerPath)
-	markerExists := (err == nil)
-	wantsDisabled := envValue == disableValue
-	// If (marker doesn't exist but the option is wanted) OR (marker exists but the option is not wanted)
-	if (!markerExists && !wantsDisabled) || (markerExists && wantsDisabled) {
-		// If the database exists
-		if _,err = os.Stat(filepath.Join(cacheDir, "mandos.db")); err == nil {
-			fmt.Printf("%s variable has changed. The database will be regenerated.\n", strings.ToUpper(filename))
-		}
-		if !markerExists { os.WriteFile(markerPath, []byte{}, 0644)
-		} else { os.Remove(markerPath) }
-		return true // Signal that a change happened
-	}
-	return false
-}
+// There are two database files, one for each visibility tier. (See tiers.go)
+// mandos.db only contains the public nodes, and mandos-full.db contains all the nodes, including the excluded lines.
+// Using a column named "public" to determine if we are going to serve the node is not enough, because of this:
+// getNodeInfo function extracts the outlinks and attachments based on the tier (Some lines can be excluded). And the getNodeInfo function is used inside upsertNodes.
+// So, the links in the excluded lines must not be in the outlinks and attachments of the public tier, but they must be in the full tier.
+// Switching ONLY_PUBLIC only switches the database file the default tier uses.
+// The schema is upgraded by the migrations, and switching the search settings only rebuilds the indexes that depend on them. (See migrations.go)
 func checkDatabaseConsistency(cacheDir string) {
-	change1 := syncMarker(cacheDir, "only_public", getEnvValue("ONLY_PUBLIC"), "no")
-	change2 := syncMarker(cacheDir, "content_search", getEnvValue("CONTENT_SEARCH"), "false")
-	if change1 || change2 {
-		os.Remove(filepath.Join(cacheDir, "mandos.db"))
-		os.Remove(filepath.Join(cacheDir, "mandos.db-shm"))
-		os.Remove(filepath.Join(cacheDir, "mandos.db-wal"))
+	dbExists := func(dbFile string) bool { _,err := os.Stat(filepath.Join(cacheDir, dbFile)); return err == nil }
+	// Older versions used a single database and an only_public marker, which was created if ONLY_PUBLIC was not "no".
+	// Without the marker, the database contains all the nodes. Keep it as the full database. Only the databases of the older versions
+	// are renamed, the newer ones keep their tier in the meta table. The marker is removed with the others. (See removeLegacyMarkers)
+	_,err := os.Stat(filepath.Join(cacheDir, "only_public"))
+	if err != nil && !dbExists("mandos-full.db") && isLegacyDatabase(filepath.Join(cacheDir, "mandos.db")) {
+		for _,suffix := range []string{"", "-shm", "-wal"} {
+			os.Rename(filepath.Join(cacheDir, "mandos.db"+suffix), filepath.Join(cacheDir, "mandos-full.db"+suffix))
+		}
 	}
+	// Older versions kept the search settings in marker files. They are moved to the meta tables of the databases.
+	importLegacyMarkers(cacheDir)
 }
 
 func InitDB() {
-	var err error
-
-	err = os.MkdirAll(getEnvValue("CACHE_FOLDER"), 0755); if err!=nil {log.Fatalln("Cache dir could not be created.", err)}
+	err := os.MkdirAll(getEnvValue("CACHE_FOLDER"), 0755); if err!=nil {log.Fatalln("Cache dir could not be created.", err)}
 
 	checkDatabaseConsistency(getEnvValue("CACHE_FOLDER"))
 
+	defaultTier = newTier(onlyPublic == "no")
+	tiers = []*Tier{defaultTier}
+	// The logged-in users see all the nodes. ONLY_PUBLIC must be "yes" if AUTH_USERS is given, so the default tier is not full.
+	if getEnvValue("AUTH_USERS") != "" {
+		memberTier = newTier(true)
+		tiers = append(tiers, memberTier)
+	}
+	for _,t := range tiers { t.openDB() }
+	// The databases have the settings of the marker files now.
+	removeLegacyMarkers(getEnvValue("CACHE_FOLDER"))
+}
+// If the database file exists and was created by the older versions, which did not set the schema version or have the meta table.
+func isLegacyDatabase(dbPath string) bool {
+	if _,err := os.Stat(dbPath); err != nil {return false}
+	db, err := sql.Open("sqlite3", "file:"+dbPath)
+	if err != nil {return false}
+	defer db.Close()
+	var version int
+	var hasMeta bool
+	if err := db.QueryRow(`PRAGMA user_version;`).Scan(&version); err != nil {return false}
+	if err := db.QueryRow(`SELECT COUNT(*) > 0 FROM sqlite_master WHERE type = 'table' AND name = 'meta'`).Scan(&hasMeta); err != nil {return false}
+	return version == 0 && !hasMeta
+}
+
+// Get the tier the database is built for, "full" or "public", from its meta table. Empty if it is not known yet.
+func databaseTier(db *sql.DB) (tier string) {
+	db.QueryRow(`SELECT value FROM meta WHERE key = 'tier'`).Scan(&tier)
+	return tier
+}
+
+func (t *Tier) openDB() {
+	var err error
+	dbPath := filepath.Join(getEnvValue("CACHE_FOLDER"), t.dbFile())
 	// Open (creates file if not exists)
-	DB, err = sql.Open("sqlite3", "file:"+filepath.Join(getEnvValue("CACHE_FOLDER"),"mandos.db"))
+	// The foreign keys are enabled by the DSN for every pooled connection, so the deletions cascade in all of them.
+	// PRAGMA foreign_keys would only enable them for the connection it runs on.
+	t.DB, err = sql.Open("sqlite3", "file:"+dbPath+"?_foreign_keys=on")
 	if err != nil { log.Fatal(err) }
 	// Ensure connection is alive
-	if err := DB.Ping(); err != nil { log.Fatal(err) }
+	if err := t.DB.Ping(); err != nil { log.Fatal(err) }
+	// A database built for the other tier has the wrong nodes and contents, so it is deleted and built again.
+	if tier := databaseTier(t.DB); tier != "" && tier != tierName(t.Full) {
+		log.Println(t.dbFile(), "was built for the", tier, "tier. It will be built again.")
+		t.DB.Close()
+		for _,suffix := range []string{"", "-shm", "-wal"} { os.Remove(dbPath+suffix) }
+		t.openDB(); return
+	}
 	// Optional pragmas for performance
-	_, _ = DB.Exec("PRAGMA journal_mode=WAL;") // Enable parallel reading on writes.
-	_, _ = DB.Exec("PRAGMA synchronous=NORMAL;")
-    _, _ = DB.Exec("PRAGMA foreign_keys = ON;") // Enable foreign keys.
-	// Create tables if they don't exist
-	if err := ensureSchema(DB); err != nil { log.Fatal(err) }
+	_, _ = t.DB.Exec("PRAGMA journal_mode=WAL;") // Enable parallel reading on writes.
+	_, _ = t.DB.Exec("PRAGMA synchronous=NORMAL;")
+	// Create the tables, or upgrade them to the current schema.
+	if err := migrate(t.DB, t.Full); err != nil { log.Fatal(t.dbFile(), ": ", err) }
+
+	// Prepare the attachment existence check and the alias lookup statements.
+	t.attExistStmt, err = t.DB.Prepare(`SELECT file FROM attachments WHERE "file" = ? LIMIT 1;`); if err != nil { log.Fatal(err) }
+	t.aliasStmt, err = t.DB.Prepare(`SELECT "to" FROM aliases WHERE alias = ? LIMIT 1;`); if err != nil { log.Fatal(err) }
+	t.tombstoneStmt, err = t.DB.Prepare(`SELECT title FROM tombstones WHERE file = ? LIMIT 1;`); if err != nil { log.Fatal(err) }
 }
-func ensureSchema(db *sql.DB) error {
-	tx, err := db.Begin()
-	if err != nil { return err }
-	defer tx.Rollback()
-
-	// Nodes: file is text (filepath), mtime as INTEGER, date as INTEGER (unix seconds), title TEXT
-	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS nodes (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		file TEXT UNIQUE,
-		mtime INTEGER NOT NULL,
-		date  INTEGER,
-		title TEXT
-	);
-	CREATE INDEX IF NOT EXISTS idx_node_file ON nodes(file);
-	CREATE INDEX IF NOT EXISTS idx_node_date ON nodes(date);
-	`)
-	if err != nil { return err }
-
-	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS outlinks (
-		"from" TEXT NOT NULL,
-		"to"   TEXT NOT NULL,
-		PRIMARY KEY ("from", "to"),
-		FOREIGN KEY ("from") REFERENCES nodes(file) ON DELETE CASCADE
-	) WITHOUT ROWID;
-	CREATE INDEX IF NOT EXISTS idx_outlink_to ON outlinks("to");
-	`)
-	if err != nil { return err }
-
-	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS attachments (
-		"from" TEXT NOT NULL,
-		file TEXT NOT NULL,
-		PRIMARY KEY ("from", file)
-		FOREIGN KEY ("from") REFERENCES nodes(file) ON DELETE CASCADE
-	) WITHOUT ROWID;
-	CREATE INDEX IF NOT EXISTS idx_attachment_file ON attachments(file);
-	`)
-	if err != nil { return err }
-
-	// Params: one row per (from, key, value). Unique constraint prevents duplicates.
-	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS params (
-		"from"  TEXT NOT NULL,
-		key   TEXT NOT NULL,
-		value TEXT NOT NULL,
-		PRIMARY KEY ("from", key, value)
-		FOREIGN KEY ("from") REFERENCES nodes(file) ON DELETE CASCADE
-	) WITHOUT ROWID;
-	CREATE INDEX IF NOT EXISTS idx_params_key_val_from ON params(key, value, "from");
-	CREATE INDEX IF NOT EXISTS idx_params_from ON params("from");
-	`)
-	if err != nil { return err }
-
-	// FTS5 Virtual Table for content searching
-	if getEnvValue("CONTENT_SEARCH") == "true" {
-		_, err = tx.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS nodes_fts USING fts5(
-			title, content,
-			content='', contentless_delete=1,
-			tokenize="unicode61 remove_diacritics 2 tokenchars '#'"
-		);`)
-		if err != nil { return err }
-		// Sync On Delete (Like ON DELETE CASCADE)
-		_, err = tx.Exec(`CREATE TRIGGER IF NOT EXISTS nodes_ad AFTER DELETE ON nodes BEGIN
-  			DELETE FROM nodes_fts WHERE rowid = old.id;
-		END;`)
-		if err != nil { return err }
-		// We first delete, then insert. No need for update sync.
-	}
-
-	return tx.Commit()
+func CloseDB() {
+	for _,t := range tiers { t.attExistStmt.Close(); t.aliasStmt.Close(); t.tombstoneStmt.Close(); t.DB.Close() }
 }
-
-// Modification times of the nodes in the db.
-// key: path of the markdown node, considering notesPath as root
-// value: modification time of the node
-var sqlNodeMtimes = make(map[string]int64)
-// Synchronize the filesystem with the database. Update modified nodes, remove deleted nodes and add new nodes.
+// Synchronize the filesystem with the databases of all tiers. Update modified nodes, remove deleted nodes and add new nodes.
 func initialSyncWithDB() {
 	fmt.Println("Syncing the database with the filesystem.")
 
 	syncStartTime := time.Now()
 
-	rows, err := DB.Query(`SELECT file, mtime FROM nodes;`)
+	for _,t := range tiers { t.initialSync() }
+	for _,t := range tiers { t.loadSchedule() }
+	// The titles of the new nodes are known now. Their wikilinks to each other can be resolved.
+	retryUnresolvedWikiLinks()
+
+	fmt.Printf("Database synchronization is completed in %v ms\n", time.Since(syncStartTime).Milliseconds())
+	if getEnvValue("CONTENT_SEARCH") == "true" || getEnvValue("SECTION_SEARCH") == "true" {
+		for _,t := range tiers { t.printFtsSize() }
+	}
+}
+func (t *Tier) initialSync() {
+	// Modification times of the nodes in the db.
+	// key: path of the markdown node, considering notesPath as root
+	// value: modification time of the node
+	var sqlNodeMtimes = make(map[string]int64)
+
+	rows, err := t.DB.Query(`SELECT file, mtime, title FROM nodes;`)
 	if err != nil { log.Fatalln(err) }
 	defer rows.Close()
 
 	for rows.Next() {
-		var file string; var mtime int64
-		if err := rows.Scan(&file, &mtime); err != nil { log.Fatalln(err) }
+		var file, title string; var mtime int64
+		if err := rows.Scan(&file, &mtime, &title); err != nil { log.Fatalln(err) }
 		sqlNodeMtimes[file] = mtime
+		// The titles of the unmodified nodes are used to resolve wikilinks. Only the default tier's titles are used, so private titles are not exposed.
+		if t == defaultTier { wikiLinks.SetTitle(file, title) }
 	}
 
 	var newNodes = make(map[string]int64) // New and modified nodes.
@@ -156,6 +133,8 @@ func initialSyncWithDB() {
 	err = filepath.WalkDir(notesPath, func(npath string, d fs.DirEntry, err error) error {
 		if err != nil {return err}
 		fileName := filepath.Base(d.Name())
+		// Every non-hidden file can be a wikilink target.
+		if t == defaultTier && !d.IsDir() && !strings.HasPrefix(fileName,".") { wikiLinks.AddFile(strings.TrimPrefix(npath, notesPath)) }
 		// Get only the non-hidden markdown files
 		if !d.IsDir() && strings.HasSuffix(fileName, ".md") && !strings.HasPrefix(fileName,".") {
 					
@@ -179,39 +158,56 @@ func initialSyncWithDB() {
 	// Delete them from the database.
 	var deletedNodes []string
 	for deletedId := range sqlNodeMtimes {deletedNodes = append(deletedNodes, deletedId)}
-	deleteNodes(deletedNodes)
+	t.deleteNodes(deletedNodes)
 
-	fmt.Println(len(deletedNodes), "node(s) are deleted from the database.")
+	fmt.Println(len(deletedNodes), "node(s) are deleted from", t.dbFile())
 
 	// Add new nodes and update updated
-	fmt.Println(upsertNodes(newNodes), "node(s) are upserted in the database.")
-
-	fmt.Printf("Database synchronization is completed in %v ms\n", time.Since(syncStartTime).Milliseconds())
+	fmt.Println(t.upsertNodes(newNodes), "node(s) are upserted in", t.dbFile())
 }
 
+// Add a tombstone for the node before deleting it, if it is in the nodes table. Parameters: reason, deletion time, file
+const buryNodeQuery = `INSERT OR REPLACE INTO tombstones (file, title, reason, deleted) SELECT file, title, ?, ? FROM nodes WHERE file = ?`
+
+// Delete the nodes from the databases of all tiers.
 func deleteNodes(nodeIds []string) {
+	for _,t := range tiers { t.deleteNodes(nodeIds) }
+}
+func (t *Tier) deleteNodes(nodeIds []string) {
     if len(nodeIds) == 0 { return }
 
-    tx, err := DB.Begin()
+    tx, err := t.DB.Begin()
     if err != nil { log.Println(err); return }
     defer tx.Rollback()
 
     delNodes, _ := tx.Prepare(`DELETE FROM nodes WHERE file = ?`)
     defer delNodes.Close()
 
+    buryNode, _ := tx.Prepare(buryNodeQuery)
+    defer buryNode.Close()
+
     for _, id := range nodeIds {
+		buryNode.Exec("deleted", time.Now().Unix(), id)
 		delNodes.Exec(id);
 		// Remove the node from the cache.
-		nodeCache.Delete(id)
+		t.nodeCache.Delete(id)
+		if t == defaultTier { wikiLinks.SetTitle(id, "") }
 	}
     tx.Commit()
 }
 
+// Upsert the nodes in the databases of all tiers. Returns the count of the nodes upserted in the default tier.
 func upsertNodes(nodeIdMTimeMap map[string]int64) (count int) {
+	for _,t := range tiers {
+		if c := t.upsertNodes(nodeIdMTimeMap); t == defaultTier { count = c }
+	}
+	return count
+}
+func (t *Tier) upsertNodes(nodeIdMTimeMap map[string]int64) (count int) {
 	if len(nodeIdMTimeMap) == 0 { return 0 }
 
 	// 1. Setup Channel and WaitGroup
-	type result struct {node  Node; mtime int64}
+	type result struct {node  Node; mtime int64; served bool}
 
 	batchSize := 1000
 
@@ -226,15 +222,16 @@ func upsertNodes(nodeIdMTimeMap map[string]int64) (count int) {
 		go func() {
 			defer wg.Done()
 			for path := range pathChan {
-				node, err := getNodeInfo(path, false)
+				node, err := getNodeInfo(path, t.Full, false)
 				if err != nil {
 					log.Println("Error getting node info:", path, err); continue
 				}
-				// Skip the private nodes.
-				if !isServed(node.Public){continue}
 				// Update the node in the cache if exists, without moving it to forward.
-				nodeCache.Update(node.File, node)
-				jobs <- result{node: node, mtime: nodeIdMTimeMap[path]}
+				t.nodeCache.Update(node.File, node)
+				// Upsert the node again when it is published or expired.
+				if next := node.NextTransition(time.Now().Unix()); next != 0 { scheduleTransition(node.File, next) }
+				// The private nodes are only deleted, in case they were public before.
+				jobs <- result{node: node, mtime: nodeIdMTimeMap[path], served: t.IsServed(&node)}
 			}
 		}()
 	}
@@ -247,7 +244,7 @@ func upsertNodes(nodeIdMTimeMap map[string]int64) (count int) {
 		close(jobs) // Close jobs once all workers are done
 	}()
 
-	tx, _ := DB.Begin() // Start the transaction
+	tx, _ := t.DB.Begin() // Start the transaction
 	defer tx.Rollback() // Rollback if a critical error happens.
 
 	// --- PREPARE STATEMENTS --- //
@@ -255,24 +252,45 @@ func upsertNodes(nodeIdMTimeMap map[string]int64) (count int) {
 	// For cleaning the non-public nodes and old attachments, params and outlinks that does not exist anymore.
 	delNodes, _ := tx.Prepare(`DELETE FROM nodes WHERE file = ?`) 
 	defer delNodes.Close()
+
+	// Add a tombstone if a served node is unpublished, and remove it if the node is served again.
+	buryNode, _ := tx.Prepare(buryNodeQuery)
+	defer buryNode.Close()
+	unburyNode, _ := tx.Prepare(`DELETE FROM tombstones WHERE file = ?`)
+	defer unburyNode.Close()
 	
 	stmtNode, _ := tx.Prepare(`INSERT INTO nodes (file, mtime, date, title) VALUES (?, ?, ?, ?)`)
 	defer stmtNode.Close()
 
-	var stmtNodeFTS *sql.Stmt
-	if getEnvValue("CONTENT_SEARCH")=="true"{
-		stmtNodeFTS, _ = tx.Prepare(`INSERT INTO nodes_fts (rowid, title, content) VALUES (?, ?, ?)`)
-		defer stmtNodeFTS.Close()
-	}
-	
+	stmtIndex := prepareIndexStmts(tx, getEnvValue("CONTENT_SEARCH")=="true", getEnvValue("SECTION_SEARCH")=="true")
+	defer stmtIndex.Close()
+
 	stmtLink, _ := tx.Prepare(`INSERT INTO outlinks ("from", "to") VALUES (?, ?)`)
 	defer stmtLink.Close()
 	
 	stmtAtt, _ := tx.Prepare(`INSERT INTO attachments ("from", "file") VALUES (?, ?)`)
 	defer stmtAtt.Close()
 	
+	// If two nodes have the same alias, the first one is kept.
+	stmtAlias, _ := tx.Prepare(`INSERT OR IGNORE INTO aliases (alias, "to") VALUES (?, ?)`)
+	defer stmtAlias.Close()
+
+	stmtSchedule, _ := tx.Prepare(`INSERT INTO schedule (file, at) VALUES (?, ?)`)
+	defer stmtSchedule.Close()
+
+	stmtHeading, _ := tx.Prepare(`INSERT INTO headings (file, position, level, text, anchor) VALUES (?, ?, ?, ?, ?)`)
+	defer stmtHeading.Close()
+
+	stmtSuggestion, _ := tx.Prepare(`INSERT INTO suggestions (file, text, kind, trigrams) VALUES (?, ?, ?, ?)`)
+	defer stmtSuggestion.Close()
+	stmtTrigram, _ := tx.Prepare(`INSERT OR IGNORE INTO suggestion_trigrams (trigram, id) VALUES (?, ?)`)
+	defer stmtTrigram.Close()
+
+	stmtFragment, _ := tx.Prepare(`INSERT INTO link_fragments ("from", "to", fragment) VALUES (?, ?, ?)`)
+	defer stmtFragment.Close()
+
 	// Using INSERT OR IGNORE to handle potential duplicate params/tags gracefully
-	stmtParam, _ := tx.Prepare(`INSERT OR IGNORE INTO params ("from", "key", "value") VALUES (?, ?, ?)`)
+	stmtParam, _ := tx.Prepare(`INSERT OR IGNORE INTO params ("from", "key", "value", "type") VALUES (?, ?, ?, ?)`)
 	defer stmtParam.Close()
 
 	// This loop runs in the main thread, pulling data as it becomes available
@@ -281,37 +299,63 @@ func upsertNodes(nodeIdMTimeMap map[string]int64) (count int) {
 		node,mtime := res.node,res.mtime
 
 		// Delete existing node.
+		if !res.served { buryNode.Exec("unpublished", time.Now().Unix(), node.File) } else { unburyNode.Exec(node.File) }
 		if _, err := delNodes.Exec(node.File); err != nil { log.Println("Error deleting node:", node.File, err) }
+		// Skip the private nodes.
+		if !res.served {
+			if t == defaultTier { wikiLinks.SetTitle(node.File, "") }
+			continue
+		}
 
 		// Insert the node
 		result, err := stmtNode.Exec(node.File, mtime, node.Date, node.Title);
 		// If it gives an error, skip inserting things related to this node completely.
 		if err != nil { log.Println("Error inserting node:", node.File, err); continue }
 
-		// Insert the index of the node content.
-		if getEnvValue("CONTENT_SEARCH")=="true" {
-			newNodeRowId, err := result.LastInsertId()
-			if err != nil{log.Println("Error while getting node's last insert id:", node.File, err)}
+		// Insert the index of the node content, and the sections and their index.
+		newNodeRowId, err := result.LastInsertId()
+		if err != nil{log.Println("Error while getting node's last insert id:", node.File, err)}
+		stmtIndex.insert(newNodeRowId, &node)
 
-			_,err = stmtNodeFTS.Exec(newNodeRowId, node.Title, node.Content)
-			if err!=nil{log.Println("Error while inserting index of the node content:",node.File, err);}
-		}
+		if t == defaultTier { wikiLinks.SetTitle(node.File, node.Title) }
 
 		// Insert Outlinks
 		for _, target := range node.OutLinks { _,err := stmtLink.Exec(node.File, target); if err!=nil{log.Println(node.File, target, err)} }
 		// Insert Attachments
 		for _, att := range node.Attachments { _,err := stmtAtt.Exec(node.File, att); if err!=nil{log.Println(node.File, att, err)} }
 
-		// Insert Params. Params is map[string]any, but values can only be string or []string
-		for key, val := range node.Params {
-			switch v := val.(type) {
-				case string: stmtParam.Exec(node.File, key, v)
+		// Insert the fragments of the links
+		for target, fragments := range node.LinkFragments {
+			for _, fragment := range fragments { _,err := stmtFragment.Exec(node.File, target, fragment); if err!=nil{log.Println(node.File, target, fragment, err)} }
+		}
 
-				case []string: for _, subVal := range v { stmtParam.Exec(node.File, key, subVal) }
+		// Insert Headings
+		for i, heading := range node.Headings {
+			_,err := stmtHeading.Exec(node.File, i, heading.Level, heading.Text, heading.ID); if err!=nil{log.Println(node.File, heading.ID, err)}
+		}
 
-				// use fmt.Sprint as fallback.
-				default: stmtParam.Exec(node.File, key, fmt.Sprint(val))
-			}
+		// Insert the texts the node is suggested with, and their trigrams.
+		for _, text := range suggestionTexts(&node) {
+			grams := trigrams(text[0])
+			if len(grams) == 0 {continue}
+			result, err := stmtSuggestion.Exec(node.File, text[0], text[1], len(grams))
+			if err != nil { log.Println("Error inserting suggestion:", node.File, text[0], err); continue }
+			suggestionId, err := result.LastInsertId()
+			if err != nil { log.Println("Error while getting suggestion's last insert id:", node.File, err); continue }
+			for _, gram := range grams { _,err := stmtTrigram.Exec(gram, suggestionId); if err!=nil{log.Println(node.File, gram, err)} }
+		}
+
+		// Insert Aliases
+		for _, alias := range node.Aliases { _,err := stmtAlias.Exec(alias, node.File); if err!=nil{log.Println(node.File, alias, err)} }
+
+		// Insert the expiry time of the node.
+		if node.Expires > time.Now().Unix() { _,err := stmtSchedule.Exec(node.File, node.Expires); if err!=nil{log.Println(node.File, err)} }
+
+		// Insert Params. The lists are saved as multiple rows with the same key, and the nested maps with dotted keys.
+		for key, val := range node.Params {
+			flattenParam(key, val, func(key string, value any, valueType string) {
+				if _,err := stmtParam.Exec(node.File, key, value, valueType); err != nil {log.Println(node.File, key, err)}
+			})
 		}
 
 		count++
@@ -322,13 +366,91 @@ func upsertNodes(nodeIdMTimeMap map[string]int64) (count int) {
 	return count
 }
 
+// The statements that insert the search indexes of the nodes. The statements of the disabled indexes are nil.
+type indexStmts struct {
+	nodeFts, section, sectionFts *sql.Stmt
+	ftsColumns []string // The metadata fields in the extra columns of nodes_fts.
+}
+
+// Prepare the statements of the content index if contentSearch is true, and of the sections if sectionSearch is true.
+func prepareIndexStmts(tx *sql.Tx, contentSearch, sectionSearch bool) (s indexStmts) {
+	if contentSearch {
+		s.ftsColumns = getFtsColumns()
+		columns, placeholders := "rowid, title, content", "?, ?, ?"
+		for _,key := range s.ftsColumns { columns += ", "+ftsColumnName(key); placeholders += ", ?" }
+		s.nodeFts, _ = tx.Prepare(`INSERT INTO nodes_fts (`+columns+`) VALUES (`+placeholders+`)`)
+	}
+	if sectionSearch {
+		s.section, _ = tx.Prepare(`INSERT INTO sections (file, anchor, heading) VALUES (?, ?, ?)`)
+		s.sectionFts, _ = tx.Prepare(`INSERT INTO sections_fts (rowid, heading, content) VALUES (?, ?, ?)`)
+	}
+	return s
+}
+func (s indexStmts) Close() {
+	for _,stmt := range []*sql.Stmt{s.nodeFts, s.section, s.sectionFts} { if stmt != nil { stmt.Close() } }
+}
+
+// Insert the index of the node content with the rowid of the node, and the sections of the node and their index.
+func (s indexStmts) insert(nodeRowId int64, node *Node) {
+	if s.nodeFts != nil {
+		_,err := s.nodeFts.Exec(append([]any{nodeRowId, node.Title, node.Content}, ftsParamValues(node, s.ftsColumns)...)...)
+		if err!=nil{log.Println("Error while inserting index of the node content:",node.File, err);}
+	}
+	if s.section != nil {
+		for _, section := range splitSections(node) {
+			result, err := s.section.Exec(node.File, section.Anchor, section.Heading)
+			if err != nil { log.Println("Error inserting section:", node.File, section.Anchor, err); continue }
+			sectionRowId, err := result.LastInsertId()
+			if err != nil { log.Println("Error while getting section's last insert id:", node.File, err); continue }
+			_,err = s.sectionFts.Exec(sectionRowId, section.Heading, section.Content)
+			if err!=nil{log.Println("Error while inserting index of the section:", node.File, section.Anchor, err)}
+		}
+	}
+}
+
+// Call add for every value of the metadata field with its SQLite value and type. The lists give multiple values with the same key,
+// and the maps give their values with the dotted keys. The empty values are skipped.
+func flattenParam(key string, val any, add func(key string, value any, valueType string)) {
+	switch v := val.(type) {
+	case string: add(key, v, "string")
+	case int: add(key, v, "int")
+	case int64: add(key, v, "int")
+	case uint64: add(key, v, "int")
+	case float64: add(key, v, "float")
+	case bool: add(key, v, "bool")
+	case time.Time: add(key, v.Unix(), "date")
+	case []string: for _,subVal := range v { add(key, subVal, "string") }
+	case []any: for _,subVal := range v { flattenParam(key, subVal, add) }
+	// The TOML arrays of tables are decoded as []map[string]any.
+	case []map[string]any: for _,subVal := range v { flattenParam(key, subVal, add) }
+	case map[string]any: for subKey, subVal := range v { flattenParam(key+"."+subKey, subVal, add) }
+	case nil:
+	// Use fmt.Sprint as fallback.
+	default: add(key, fmt.Sprint(v), "string")
+	}
+}
+
+// The values of the metadata fields for the extra columns of nodes_fts. The values of a field are joined with spaces.
+func ftsParamValues(node *Node, keys []string) []any {
+	values := make(map[string][]string)
+	for key, val := range node.Params {
+		flattenParam(key, val, func(key string, value any, valueType string) { values[key] = append(values[key], fmt.Sprint(value)) })
+	}
+	columns := make([]any, len(keys))
+	for i, key := range keys { columns[i] = strings.Join(values[key], " ") }
+	return columns
+}
+
+// Execute the query in the database of the default tier.
+func Query(queryStr string, queryVals []any) []map[string]any { return defaultTier.Query(queryStr, queryVals) }
+
 // Execute the queryStr with queryVals values, then return the rows in []map[string]any where key is the column name and value is the column value.
-func Query(queryStr string, queryVals []any) (returnData []map[string]any) {
+func (t *Tier) Query(queryStr string, queryVals []any) (returnData []map[string]any) {
 	// Prefer the cached data.
-	returnData, exists := queryCache.Get(GetQueryKey(queryStr, queryVals...))
+	returnData, exists := t.queryCache.Get(GetQueryKey(queryStr, queryVals...))
 	if exists {return returnData}
 
-	rows, err := DB.Query(queryStr, queryVals...)
+	rows, err := t.DB.Query(queryStr, queryVals...)
 	if err!=nil{log.Println(err); return returnData}
 	defer rows.Close()
 	// Get the column names
@@ -356,7 +478,7 @@ func Query(queryStr string, queryVals []any) (returnData []map[string]any) {
 
 	// Cache the returned data if not empty.
 	if len(returnData) > 0 {
-		queryCache.Set(GetQueryKey(queryStr, queryVals...), returnData, time.Second*10)
+		t.queryCache.Set(GetQueryKey(queryStr, queryVals...), returnData, time.Second*10)
 	}
 
 	return returnData
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"; "encoding/json"; "fmt"; "reflect"; "sort"; "strings"
+)
+
+// Template functions to shape the Query results and other values, and to serialize them as JSON.
+// The errors are returned, so the template execution fails instead of writing a broken output.
+
+// Encode the value as JSON. HTML characters are not escaped, the HTML templates escape the output by its context.
+func ToJson(value any) (string, error) {return encodeJson(value, "")}
+
+// Encode the value as indented JSON, like ToJson.
+func ToJsonIndent(value any, indent string) (string, error) {return encodeJson(value, indent)}
+
+func encodeJson(value any, indent string) (string, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if indent != "" { encoder.SetIndent("", indent) }
+	if err := encoder.Encode(value); err != nil {return "", err}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// Decode the JSON string. Objects become map[string]any, arrays become []any and numbers become float64.
+func FromJson(str string) (value any, err error) {
+	err = json.Unmarshal([]byte(str), &value)
+	return value, err
+}
+
+// Create a map from the key and value pairs. Example: Dict "title" .Title "file" .File
+func Dict(pairs ...any) (map[string]any, error) {
+	if len(pairs)%2 != 0 {return nil, fmt.Errorf("Dict needs key and value pairs, got %d values", len(pairs))}
+	dict := make(map[string]any, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		key, ok := pairs[i].(string)
+		if !ok {return nil, fmt.Errorf("Dict keys must be strings, got %T", pairs[i])}
+		dict[key] = pairs[i+1]
+	}
+	return dict, nil
+}
+
+// Create a list from the values.
+func List(items ...any) []any {
+	if items == nil {return []any{}}
+	return items
+}
+
+// Return a new list with the items added to the end of the list.
+func Append(list any, items ...any) ([]any, error) {
+	slice, err := toSlice(list)
+	if err != nil {return nil, err}
+	return append(slice, items...), nil
+}
+
+// Sort the list. If the key is given, the maps in the list are sorted by their key field. The order can be "asc" or "desc".
+// Numbers are compared by their values, and the nil values come first. Example: Sort (Query ...) "date" "desc"
+func Sort(list any, keyAndOrder ...string) ([]any, error) {
+	slice, err := toSlice(list)
+	if err != nil {return nil, err}
+	if len(keyAndOrder) > 2 {return nil, fmt.Errorf("Sort takes a key and an order, got %q", keyAndOrder)}
+
+	var key, order string
+	if len(keyAndOrder) > 0 { key = keyAndOrder[0] }
+	if len(keyAndOrder) > 1 { order = keyAndOrder[1] }
+	if order != "" && order != "asc" && order != "desc" {return nil, fmt.Errorf("Sort order must be asc or desc, got %q", order)}
+
+	sorted := append([]any{}, slice...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if order == "desc" {return compareValues(field(sorted[j], key), field(sorted[i], key)) < 0}
+		return compareValues(field(sorted[i], key), field(sorted[j], key)) < 0
+	})
+	return sorted, nil
+}
+
+// Filter the maps in the list by their key field. The operator can be omitted for equality.
+// Operators: = != < <= > >= in (the value is a list that contains the field) contains (the field is a string or a list that contains the value)
+// Example: Where (Query ...) "date" ">" 0
+func Where(list any, key string, args ...any) ([]any, error) {
+	slice, err := toSlice(list)
+	if err != nil {return nil, err}
+
+	var operator string; var value any
+	switch len(args) {
+	case 1: operator, value = "=", args[0]
+	case 2:
+		op, ok := args[0].(string)
+		if !ok {return nil, fmt.Errorf("Where operator must be a string, got %T", args[0])}
+		operator, value = op, args[1]
+	default: return nil, fmt.Errorf("Where takes an operator and a value, got %d arguments", len(args))
+	}
+
+	filtered := []any{}
+	for _,item := range slice {
+		matched, err := matchValue(field(item, key), operator, value)
+		if err != nil {return nil, err}
+		if matched { filtered = append(filtered, item) }
+	}
+	return filtered, nil
+}
+
+// Return the list without the duplicate items, keeping the first ones.
+func Uniq(list any) ([]any, error) {
+	slice, err := toSlice(list)
+	if err != nil {return nil, err}
+	seen := make(map[string]bool)
+	unique := []any{}
+	for _,item := range slice {
+		// Maps and slices are not comparable, so compare their printed forms. The map keys are printed in order.
+		key := fmt.Sprintf("%T:%v", item, item)
+		if seen[key] {continue}
+		seen[key] = true
+		unique = append(unique, item)
+	}
+	return unique, nil
+}
+
+// Return the first item of the list, or nil if the list is empty.
+func First(list any) (any, error) {
+	slice, err := toSlice(list)
+	if err != nil || len(slice) == 0 {return nil, err}
+	return slice[0], nil
+}
+
+// Return the last item of the list, or nil if the list is empty.
+func Last(list any) (any, error) {
+	slice, err := toSlice(list)
+	if err != nil || len(slice) == 0 {return nil, err}
+	return slice[len(slice)-1], nil
+}
+
+// Create a sequence of integers. Seq 3 is [1 2 3], Seq 2 4 is [2 3 4] and Seq 0 5 20 is [0 5 10 15 20].
+// The step can be negative to count down.
+func Seq(args ...int) ([]int, error) {
+	first, step, last := 1, 1, 0
+	switch len(args) {
+	case 1: last = args[0]
+	case 2: first, last = args[0], args[1]
+	case 3: first, step, last = args[0], args[1], args[2]
+	default: return nil, fmt.Errorf("Seq takes 1 to 3 arguments, got %d", len(args))
+	}
+	if len(args) == 2 && first > last { step = -1 }
+	if step == 0 {return nil, fmt.Errorf("Seq step cannot be zero")}
+	if (step > 0 && first > last) || (step < 0 && first < last) {return []int{}, nil}
+	// The distance and the step are counted in uint64, so the huge ranges like Seq 0 9223372036854775807 do not overflow.
+	distance, stepSize := uint64(last)-uint64(first), uint64(step)
+	if step < 0 { distance, stepSize = uint64(first)-uint64(last), -uint64(step) }
+	if distance/stepSize >= 100000 {return nil, fmt.Errorf("Seq is too long")}
+
+	count := int(distance/stepSize)+1
+	seq := make([]int, count)
+	for i := range count { seq[i] = first + i*step }
+	return seq, nil
+}
+
+// Convert any slice or array, like the Query results, to []any. nil is an empty list.
+func toSlice(list any) ([]any, error) {
+	if list == nil {return []any{}, nil}
+	if slice, ok := list.([]any); ok {return slice, nil}
+
+	v := reflect.ValueOf(list)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {return nil, fmt.Errorf("expected a list, got %T", list)}
+	slice := make([]any, v.Len())
+	for i := range v.Len() { slice[i] = v.Index(i).Interface() }
+	return slice, nil
+}
+
+// Get the key field of the item if it is a map with string keys. If the key is empty, the item itself is returned.
+func field(item any, key string) any {
+	if key == "" {return item}
+	if m, ok := item.(map[string]any); ok {return m[key]}
+
+	v := reflect.ValueOf(item)
+	if v.Kind() != reflect.Map || v.Type().Key().Kind() != reflect.String {return nil}
+	value := v.MapIndex(reflect.ValueOf(key).Convert(v.Type().Key()))
+	if !value.IsValid() {return nil}
+	return value.Interface()
+}
+
+// Convert the numbers to float64, so the integers from the database and the floats from JSON can be compared.
+func toNumber(value any) (float64, bool) {
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64: return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64: return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64: return v.Float(), true
+	}
+	return 0, false
+}
+
+// Compare two values. Numbers are compared by their values and strings alphabetically. nil is less than everything.
+// The other values are compared by their printed forms.
+func compareValues(a, b any) int {
+	switch {
+	case a == nil && b == nil: return 0
+	case a == nil: return -1
+	case b == nil: return 1
+	}
+	if x, ok := toNumber(a); ok {
+		if y, ok := toNumber(b); ok {
+			switch { case x < y: return -1; case x > y: return 1 }
+			return 0
+		}
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+func matchValue(fieldValue any, operator string, value any) (bool, error) {
+	switch operator {
+	case "=", "==": return compareValues(fieldValue, value) == 0, nil
+	case "!=": return compareValues(fieldValue, value) != 0, nil
+	case "<": return fieldValue != nil && compareValues(fieldValue, value) < 0, nil
+	case "<=": return fieldValue != nil && compareValues(fieldValue, value) <= 0, nil
+	case ">": return compareValues(fieldValue, value) > 0, nil
+	case ">=": return compareValues(fieldValue, value) >= 0, nil
+	case "in":
+		values, err := toSlice(value)
+		if err != nil {return false, err}
+		for _,v := range values { if compareValues(fieldValue, v) == 0 {return true, nil} }
+		return false, nil
+	case "contains":
+		if str, ok := fieldValue.(string); ok {return strings.Contains(str, fmt.Sprint(value)), nil}
+		values, err := toSlice(fieldValue)
+		if err != nil {return false, nil}
+		for _,v := range values { if compareValues(v, value) == 0 {return true, nil} }
+		return false, nil
+	}
+	return false, fmt.Errorf("unknown Where operator: %q", operator)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"; "errors"; "fmt"; "log"; "strconv"; "time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// Respond with the error status. The <status>.html template in MD_TEMPLATES is used if it exists, like 404.html, 403.html,
+// 410.html, 429.html and 500.html. It gets the status and its message in {{.Status}} and {{.Error}}. The actual errors
+// are only logged, never shown to the visitors. If node is nil, a node with the request path and the status as its title is given.
+func sendError(c *fiber.Ctx, status int, node *Node) error {
+	message := utils.StatusMessage(status)
+	if message == "" { message = "Error" }
+	if node == nil { node = &Node{File: c.Path(), Title: fmt.Sprintf("%d %s", status, message)} }
+	pagevars := PageVars{
+		Url: c.BaseURL()+c.OriginalURL(), Node: node, Ctx: c, Now: time.Now().Unix(), User: getUser(c), Status: status, Error: message,
+	}
+
+	// If there is no template for the status, the error is shown in main.html like a node.
+	errorTemplate := getMdTemplate(strconv.Itoa(status)+".html")
+	if errorTemplate == nil {
+		errorTemplate = getMdTemplate("main.html")
+		pagevars.Node = &Node{File: node.File, Title: fmt.Sprintf("%d %s", status, message), Content: fmt.Sprintf("<p>%d %s</p><p><a href=\"/\">Return To Index</a></p>", status, message)}
+	}
+
+	c.Status(status)
+	c.Set("Content-Type", "text/html; charset=utf-8")
+	if errorTemplate != nil {
+		buf := new(bytes.Buffer)
+		err := getTier(c).Template(errorTemplate).Execute(buf, pagevars)
+		if err == nil {return c.Send(buf.Bytes())}
+		log.Printf("Error Template Error: %v", err)
+	}
+	// The template may have changed the status.
+	return c.Status(status).SendString(fmt.Sprintf("%d %s", status, message))
+}
+
+// Render the errors returned from the handlers and the middlewares with the error templates.
+// Unexpected errors are logged, and the visitors get 500 Internal Server Error.
+func errorHandler(c *fiber.Ctx, err error) error {
+	status := fiber.StatusInternalServerError
+	var fiberErr *fiber.Error
+	if errors.As(err, &fiberErr) { status = fiberErr.Code } else { log.Println("Error:", c.Path(), err) }
+	return sendError(c, status, nil)
+}
+
+// The rate limiters respond with the 429.html template.
+func limitReached(c *fiber.Ctx) error {return sendError(c, fiber.StatusTooManyRequests, nil)}
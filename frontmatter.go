@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"; "encoding/json"; "errors"; "fmt"; "regexp"; "strconv"; "strings"; "time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// The metadata block at the start of a node can be YAML between "---" lines, TOML between "+++" lines, or a JSON object.
+const (
+	yamlFrontmatter = "yaml"
+	tomlFrontmatter = "toml"
+	jsonFrontmatter = "json"
+)
+
+// Split the metadata block from the content. The format is empty if the node has no metadata.
+// metaLine is the line number of the first metadata line in the file, used in the error messages.
+func splitFrontmatter(data []byte) (meta []byte, format string, body []byte, metaLine int) {
+	firstLine, rest, _ := bytes.Cut(data, []byte("\n"))
+
+	for delimiter, format := range map[string]string{"---": yamlFrontmatter, "+++": tomlFrontmatter} {
+		if string(firstLine) != delimiter {continue}
+		// If the block is not closed, the rest of the file is the metadata.
+		lines := bytes.SplitAfter(rest, []byte("\n"))
+		for i, line := range lines {
+			if string(bytes.TrimSuffix(line, []byte("\n"))) == delimiter {
+				return bytes.Join(lines[:i], nil), format, bytes.Join(lines[i+1:], nil), 2
+			}
+		}
+		return rest, format, nil, 2
+	}
+
+	if bytes.HasPrefix(data, []byte("{")) {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		var object json.RawMessage
+		if err := decoder.Decode(&object); err == nil {
+			end := int(decoder.InputOffset())
+			// The content starts at the next line.
+			if i := bytes.IndexByte(data[end:], '\n'); i != -1 { end += i+1 } else { end = len(data) }
+			return data[:end], jsonFrontmatter, data[end:], 1
+		}
+		// A lone "{" line can only start a JSON object, so report its errors. Otherwise, it is a part of the content.
+		if string(bytes.TrimSpace(firstLine)) == "{" {return data, jsonFrontmatter, nil, 1}
+	}
+
+	return nil, "", data, 0
+}
+
+var yamlLineRe = regexp.MustCompile(`line (\d+)`)
+
+// Parse the metadata block. The errors start with the file and the line, like "/note.md:3: ..."
+func parseFrontmatter(relPath string, meta []byte, format string, metaLine int) (params map[string]any, err error) {
+	switch format {
+	case yamlFrontmatter:
+		if err = yaml.Unmarshal(meta, &params); err == nil {return params, nil}
+		// The YAML errors give the lines in the metadata block.
+		var messages []string
+		var typeErr *yaml.TypeError
+		if errors.As(err, &typeErr) { messages = typeErr.Errors } else { messages = []string{strings.TrimPrefix(err.Error(), "yaml: ")} }
+		for i, message := range messages {
+			match := yamlLineRe.FindStringSubmatch(message)
+			if match == nil { messages[i] = fmt.Sprintf("%s: %s", relPath, message); continue }
+			line, _ := strconv.Atoi(match[1])
+			message = strings.TrimPrefix(strings.Replace(message, match[0], "", 1), ": ")
+			messages[i] = fmt.Sprintf("%s:%d: %s", relPath, line+metaLine-1, message)
+		}
+		return nil, errors.New(strings.Join(messages, "\n"))
+
+	case tomlFrontmatter:
+		if _, err = toml.Decode(string(meta), &params); err == nil {return params, nil}
+		var parseErr toml.ParseError
+		if errors.As(err, &parseErr) {return nil, fmt.Errorf("%s:%d: %s", relPath, parseErr.Position.Line+metaLine-1, parseErr.Message)}
+		return nil, fmt.Errorf("%s: %w", relPath, err)
+
+	case jsonFrontmatter:
+		decoder := json.NewDecoder(bytes.NewReader(meta))
+		decoder.UseNumber()
+		if err = decoder.Decode(&params); err != nil {
+			var offset int64 = -1
+			var syntaxErr *json.SyntaxError; var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &syntaxErr) { offset = syntaxErr.Offset } else if errors.As(err, &typeErr) { offset = typeErr.Offset }
+			if offset < 0 {return nil, fmt.Errorf("%s: %w", relPath, err)}
+			line := bytes.Count(meta[:min(int(offset), len(meta))], []byte("\n")) + metaLine
+			return nil, fmt.Errorf("%s:%d: %w", relPath, line, err)
+		}
+		// JSON has no integers or dates. Convert the numbers, and the dates of the fields that must be dates.
+		params = convertJsonNumbers(params).(map[string]any)
+		for _,key := range []string{"date", "publish_at", "expires"} {
+			str, ok := params[key].(string)
+			if !ok {continue}
+			for _,layout := range []string{time.RFC3339, time.DateTime, time.DateOnly} {
+				if date, err := time.Parse(layout, str); err == nil { params[key] = date; break }
+			}
+		}
+		return params, nil
+	}
+	return nil, nil
+}
+
+// Convert the json.Number values to int64 or float64, like the other formats give.
+func convertJsonNumbers(value any) any {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {return i}
+		f, _ := v.Float64(); return f
+	case []any: for i := range v { v[i] = convertJsonNumbers(v[i]) }
+	case map[string]any: for key := range v { v[key] = convertJsonNumbers(v[key]) }
+	}
+	return value
+}
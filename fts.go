@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"; "html"; "log"; "regexp"; "strconv"; "strings"
+)
+
+// The FTS5 settings of nodes_fts and sections_fts.
+// The tokenizer, the extra columns and storing the content change the index, so the FTS tables are rebuilt if they change. (See syncSettings)
+// The weights are only used for ranking, so they are applied on every start.
+const defaultFtsTokenizer = "unicode61 remove_diacritics 2 tokenchars '#'"
+
+var ftsTokenizers = map[string]bool{"unicode61": true, "ascii": true, "porter": true, "trigram": true}
+
+// The metadata fields indexed in the extra columns of nodes_fts, in the FTS_COLUMNS order.
+func getFtsColumns() (keys []string) {
+	for _,key := range Split(getEnvValue("FTS_COLUMNS"), ",") {
+		if key = strings.TrimSpace(key); key != "" { keys = append(keys, key) }
+	}
+	return keys
+}
+
+var ftsColumnRe = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+
+// The column name of the metadata field in nodes_fts, like author_name for author.name
+func ftsColumnName(key string) string { return strings.ToLower(ftsColumnRe.ReplaceAllString(key, "_")) }
+
+// The weights of the title, content and extra columns. The title weighs 10, and the others 1, if they are not given.
+func getFtsWeights() (weights []float64) {
+	given := Split(getEnvValue("FTS_WEIGHTS"), ",")
+	for i := range 2+len(getFtsColumns()) {
+		weight := 1.0
+		if i == 0 { weight = 10 }
+		if i < len(given) { if w, err := strconv.ParseFloat(strings.TrimSpace(given[i]), 64); err == nil { weight = w } }
+		weights = append(weights, weight)
+	}
+	return weights
+}
+
+// The rank function of a FTS5 table with the weights, like bm25(10, 1)
+func ftsRank(weights []float64) string {
+	var parts []string
+	for _,w := range weights { parts = append(parts, strconv.FormatFloat(w, 'f', -1, 64)) }
+	return "bm25("+strings.Join(parts, ", ")+")"
+}
+
+// Quote the tokenizer as an SQL string for the tokenize option.
+func ftsTokenizeOption() string {
+	return "tokenize = '"+strings.ReplaceAll(getEnvValue("FTS_TOKENIZER"), "'", "''")+"'"
+}
+
+// If the FTS tables store the content, so snippet() and highlight() can be used. Otherwise, they only keep the index.
+func ftsStoresContent() bool { return getEnvValue("FTS_STORE_CONTENT") == "true" }
+
+// The private use characters that mark the matches in snippet(). The content can contain <b>, so the snippet is escaped first,
+// and then the markers are replaced with the tags. (See snippetHtml)
+const snippetStart, snippetEnd = "\uE000", "\uE001"
+
+// Escape the snippet and wrap its matches marked with snippetStart and snippetEnd in <b>, like GetContentMatch.
+func snippetHtml(snippet string) string {
+	return strings.NewReplacer(snippetStart, "<b>", snippetEnd, "</b>").Replace(html.EscapeString(snippet))
+}
+
+// The options of the FTS tables for their content. The contentless tables are smaller, but cannot give their content back.
+func ftsContentOption() string {
+	if ftsStoresContent() {return ""}
+	return "content='', contentless_delete=1,"
+}
+
+// The settings that change the FTS index, kept as fts_config in the meta table.
+func ftsIndexConfig(tokenizer string, columns []string, storesContent bool) string {
+	return fmt.Sprintf("tokenizer=%s\ncolumns=%s\nstored=%t\n", tokenizer, strings.Join(columns, ","), storesContent)
+}
+
+// Print the size of the database, and how much of it is used by the FTS index and the stored content.
+func (t *Tier) printFtsSize() {
+	var dbSize int64
+	if err := t.DB.QueryRow(`SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()`).Scan(&dbSize); err != nil {log.Println(err); return}
+
+	var indexSize, contentSize int64
+	for table, columns := range map[string]int{"nodes_fts": 2+len(getFtsColumns()), "sections_fts": 2} {
+		var exists bool
+		if err := t.DB.QueryRow(`SELECT COUNT(*) > 0 FROM sqlite_master WHERE type = 'table' AND name = ?`, table).Scan(&exists); err != nil || !exists {continue}
+		var size int64
+		if err := t.DB.QueryRow(`SELECT COALESCE(SUM(length(block)), 0) FROM `+table+`_data`).Scan(&size); err == nil { indexSize += size }
+		if !ftsStoresContent() {continue}
+		var lengths []string
+		for i := range columns { lengths = append(lengths, fmt.Sprintf("COALESCE(length(c%d), 0)", i)) }
+		if err := t.DB.QueryRow(`SELECT COALESCE(SUM(`+strings.Join(lengths, " + ")+`), 0) FROM `+table+`_content`).Scan(&size); err == nil { contentSize += size }
+	}
+
+	mib := func(size int64) float64 {return float64(size)/1024/1024}
+	if ftsStoresContent() {
+		fmt.Printf("%s is %.2f MiB. The full-text index uses %.2f MiB, and the stored content uses %.2f MiB.\n", t.dbFile(), mib(dbSize), mib(indexSize), mib(contentSize))
+	} else {
+		fmt.Printf("%s is %.2f MiB. The full-text index uses %.2f MiB. The content is not stored.\n", t.dbFile(), mib(dbSize), mib(indexSize))
+	}
+}
+
+func validateFtsConfig() (problems []string) {
+	tokenizer := strings.Fields(getEnvValue("FTS_TOKENIZER"))
+	if len(tokenizer) == 0 || !ftsTokenizers[tokenizer[0]] {
+		problems = append(problems, fmt.Sprintf("FTS_TOKENIZER must start with one of unicode61, ascii, porter or trigram, got %q", getEnvValue("FTS_TOKENIZER")))
+	}
+
+	columns := map[string]bool{"title": true, "content": true}
+	for _,key := range getFtsColumns() {
+		name := ftsColumnName(key)
+		if strings.Trim(name, "_") == "" || columns[name] { problems = append(problems, fmt.Sprintf("FTS_COLUMNS has a duplicate or invalid column: %q", key)) }
+		columns[name] = true
+	}
+
+	weights := Split(getEnvValue("FTS_WEIGHTS"), ",")
+	if len(weights) > 2+len(getFtsColumns()) { problems = append(problems, "FTS_WEIGHTS has more weights than the title, content and FTS_COLUMNS columns") }
+	for _,weight := range weights {
+		if w, err := strconv.ParseFloat(strings.TrimSpace(weight), 64); err != nil || w < 0 { problems = append(problems, fmt.Sprintf("FTS_WEIGHTS must be non-negative numbers, got %q", weight)) }
+	}
+	return problems
+}
@@ -3,16 +3,19 @@ module mandos
 go 1.24.7
 
 require (
+	github.com/BurntSushi/toml v1.6.0
 	github.com/cespare/xxhash/v2 v2.3.0
 	github.com/fsnotify/fsnotify v1.7.0
 	github.com/gofiber/fiber/v2 v2.52.5
 	github.com/knaka/go-sqlite3-fts5 v0.0.0-20240729040425-e53b86878d0d
 	github.com/mattn/go-sqlite3 v1.14.32
 	github.com/mdigger/goldmark-attributes v0.0.0-20210529130523-52da21a6bf2b
+	github.com/valyala/fasthttp v1.51.0
 	github.com/yuin/goldmark v1.7.13
 	github.com/zenarvus/goldmark-bettermedia v0.0.0-20251027164908-a7a4869f71d3
 	github.com/zenarvus/goldmark-headingid v0.0.0-20251106094144-dd884481d924
 	github.com/zenarvus/goldmark-mathjax v0.0.0-20251016143638-b6040e338455
+	golang.org/x/crypto v0.40.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
@@ -27,7 +30,6 @@ require (
 	github.com/rivo/uniseg v0.2.0 // indirect
 	github.com/tinylib/msgp v1.1.8 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
-	github.com/valyala/fasthttp v1.51.0 // indirect
 	github.com/valyala/tcplisten v1.0.0 // indirect
 	golang.org/x/sys v0.34.0 // indirect
 )
@@ -1,11 +1,17 @@
 package main
 import ("fmt"; "log"; "os"; "path"; "path/filepath"; "strings"; "unicode"; "unicode/utf8"; "bytes"; "strconv"; "github.com/cespare/xxhash/v2";)
 
-var notesPath = getNotesPath() //it does not and should not have a slash suffix.
-var onlyPublic = getEnvValue("ONLY_PUBLIC")
-var indexPage = getEnvValue("INDEX")
-
-func isServed(publicField bool)bool{return onlyPublic=="no" || publicField==true}
+var notesPath string //it does not and should not have a slash suffix.
+var onlyPublic string
+var indexPage string
+
+// Load and validate the configuration, then set the settings used everywhere. It must be called before anything uses them.
+func initSettings() error {
+	if err := loadConfig(); err != nil {return err}
+	notesPath = getNotesPath(); onlyPublic = getEnvValue("ONLY_PUBLIC"); indexPage = getEnvValue("INDEX")
+	prettyUrls = getEnvValue("PRETTY_URLS") == "true"
+	return nil
+}
 
 var envValues = make(map[string]string)
 func getEnvValue(key string)string{
@@ -15,18 +21,24 @@ func getEnvValue(key string)string{
 	// If environment variable has a value, return it.
 	if os.Getenv(key) != "" { envValues[key]=os.Getenv(key); return envValues[key]}
 
-	// If no value is assigned to the environment variable, use the default one or give an error.
+	// If the configuration file has a value, return it.
+	if configValues[key] != "" { envValues[key]=configValues[key]; return envValues[key]}
+
+	// If no value is assigned to the environment variable, use the default one.
+	// MD_FOLDER has no default value, loadConfig reports it if it is not given.
 	switch key {
-	case "MD_FOLDER":
-		log.Fatal(fmt.Errorf("Please specify markdown folder path with MD_FOLDER environment variable."))
 	case "INDEX":
 		envValues[key]="index.md"; return envValues[key]
 	case "PORT":
 		envValues["PORT"]="9700"; return envValues["PORT"]
 	case "ONLY_PUBLIC":
 		envValues[key]="yes"; return envValues[key]
-	case "CONTENT_SEARCH":
+	case "CONTENT_SEARCH", "SECTION_SEARCH":
 		envValues[key]="false"; return envValues[key]
+	case "FTS_TOKENIZER":
+		envValues[key]=defaultFtsTokenizer; return envValues[key]
+	case "HTML_TEMPLATES":
+		envValues[key]=".html"; return envValues[key]
 	case "CACHE_FOLDER":
 		userCache, err := os.UserCacheDir();
 		if err!=nil{log.Fatalln("Cache dir could not be determined. Please specify it using CACHE_FOLDER", err)}
@@ -39,7 +51,7 @@ func getEnvValue(key string)string{
 	return ""
 }
 
-// Used to convert some environment variables to integers. So it's okay to give fatal errors.
+// Used to convert some environment variables to integers. They are validated by loadConfig, so it's okay to give fatal errors.
 func convertToInt(str string) int {
 	int, err := strconv.Atoi(str)
 	if err!=nil{log.Fatalln("Environment variable error:",err)}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"database/sql"; "fmt"; "log"; "mime"; "path"; "path/filepath"; "runtime"
+	"database/sql"; "fmt"; "log"; "mime"; "os"; "path"; "path/filepath"; "runtime"
 	"strings"; "time"; "bytes"
 
 	"github.com/gofiber/fiber/v2"
@@ -9,18 +9,30 @@ import (
 	"github.com/gofiber/fiber/v2/middleware/limiter"
 )
 
+type PageVars struct { Now int64; Url string; *Node; Ctx *fiber.Ctx; User string; Status int; Error string; }
+
 func main() {
-	InitDB(); defer DB.Close()
+	// The configuration is read before the subcommands, so they are configured the same way.
+	if err := initSettings(); err != nil { fmt.Fprintln(os.Stderr, err); os.Exit(1) }
+
+	// Export the served nodes as a static site instead of running the server.
+	if len(os.Args) > 1 && os.Args[1] == "build" { buildStaticSite(os.Args[2:]); return }
+
+	InitDB(); defer CloseDB()
 
 	fmt.Println("Folder:",notesPath); fmt.Println("Index:", indexPage)
 
-	loadAllTemplates("md"); loadAllTemplates("solo");
+	loadAllTemplates("md"); loadAllTemplates("solo"); loadRedirects()
 
 	initialSyncWithDB()
 
 	var servedNodes int
-	DB.QueryRow(`SELECT COUNT(*) FROM nodes`).Scan(&servedNodes)
+	defaultTier.DB.QueryRow(`SELECT COUNT(*) FROM nodes`).Scan(&servedNodes)
 	fmt.Println("Nodes Served:", servedNodes)
+	if memberTier != nil {
+		memberTier.DB.QueryRow(`SELECT COUNT(*) FROM nodes`).Scan(&servedNodes)
+		fmt.Println("Nodes Served To Members:", servedNodes)
+	}
 
 	go watchFileChanges()
 
@@ -30,6 +42,7 @@ func main() {
 		ReadTimeout:  5 * time.Second,  // Time allowed to read the full request body
 		WriteTimeout: 10 * time.Second, // Time allowed to write the response
 		IdleTimeout:  120 * time.Second, // Time a keep-alive connection stays open
+		ErrorHandler: errorHandler, // Render the errors with the error templates.
 	}
 
 	behindProxy := getEnvValue("BEHIND_PROXY")
@@ -37,8 +50,7 @@ func main() {
 
 	app := fiber.New(fiberConfig)
 
-	attExistStmt := initRoutes(app)
-	if attExistStmt != nil { defer attExistStmt.Close() }
+	initRoutes(app)
 
 	var m runtime.MemStats; runtime.ReadMemStats(&m)
 	fmt.Printf("Memory Used: %.2f MiB\n", float64(m.Sys)/1024/1024)
@@ -52,16 +64,17 @@ func main() {
 		err := app.ListenTLS(":"+getEnvValue("PORT"),certFile,keyFile); if err!=nil{panic(err)}
 	}
 }
-func initRoutes(app *fiber.App) *sql.Stmt {
+func initRoutes(app *fiber.App) {
 
 	noAttCheck := getEnvValue("NO_ATTACHMENT_CHECK") == "true"
-	// Prepare the attachment existence check statement.
-	attExistStmt,_ := DB.Prepare(`SELECT file FROM attachments WHERE "file" = ? LIMIT 1;`)
 
 	if getEnvValue("LOGGING")=="true" {
 		app.Use(func(c *fiber.Ctx)error{ log.Println(c.IP(), c.Path()); return c.Next() })
 	}
 
+	// The logged-in users are served with the member tier.
+	if memberTier != nil { initAuthRoutes(app) }
+
 	// Set the rate limits for markdown and attachments, also set the limit values for solo templates.
 	rateLimitStr := getEnvValue("RATE_LIMIT")
 	var limits []string
@@ -74,10 +87,10 @@ func initRoutes(app *fiber.App) *sql.Stmt {
 		if len(parts) != 3 {log.Fatalln("Malformed rate limit setting:", limit)}
 
 		var limitSkipFuncs = map[string]func(path string)bool{
-			// If it is not a markdown file, skip the limiter middleware. Else, use it.
-			"!md": func(path string)bool{ return !strings.HasSuffix(path, ".md") },
-			// If it is not a markdown file or a solo template, skip the limiter middleware. Else, use it.
-			"!att": func(path string)bool{ return strings.HasSuffix(path, ".md") || soloTemplates[path] != nil },
+			// If it is not a markdown file or an API request, skip the limiter middleware. Else, use it.
+			"!md": func(path string)bool{ return !(isNodeRequest(path) || isApiRequest(path)) || soloTemplates[path] != nil },
+			// If it is a markdown file, an API request or a solo template, skip the limiter middleware. Else, use it.
+			"!att": func(path string)bool{ return isNodeRequest(path) || isApiRequest(path) || soloTemplates[path] != nil },
 		}
 		// Implement rate limiting for markdown files and attachments.
 		if parts[0] == "!md" || parts[0] == "!att" {
@@ -88,6 +101,7 @@ func initRoutes(app *fiber.App) *sql.Stmt {
 				Expiration: time.Duration(convertToInt(parts[1])) * time.Second,
 				Max: convertToInt(parts[2]),
 				KeyGenerator: func(c *fiber.Ctx) string { return c.IP() },
+				LimitReached: limitReached,
 			}))
 			log.Println("Rate limit is applied for", parts[0])
 		
@@ -98,18 +112,16 @@ func initRoutes(app *fiber.App) *sql.Stmt {
 
 	}
 
-	// Compress with gzip if its ends with ,css, .html, .json, js, .xml, txt or md. Skip compression if its not them
+	// Compress with gzip if its ends with ,css, .html, .json, js, .xml, txt or md, or if its a node. Skip compression if its not them
 	var compressed = map[string]bool{".md":true, ".js":true, ".css":true, ".txt":true, ".json":true, ".xml":true, ".html":true}
 	app.Use(compress.New(compress.Config{
-		Next:  func(c *fiber.Ctx) bool { return !compressed[ filepath.Ext(c.Path()) ] },
+		Next:  func(c *fiber.Ctx) bool { return !compressed[ filepath.Ext(c.Path()) ] && !isNodeRequest(c.Path()) },
 		Level: compress.LevelBestSpeed, // 1
 	}))
 
 	// All files in static folder are served
 	app.Static("/static", path.Join(notesPath,"/static"), fiber.Static{MaxAge:60*60*24*7})
 
-	type PageVars struct { Now int64; Url string; *Node; Ctx *fiber.Ctx; }
-
 	// Serve the solo templates.
 	for soloPath := range soloTemplates {
 
@@ -120,23 +132,22 @@ func initRoutes(app *fiber.App) *sql.Stmt {
 				contentType := mime.TypeByExtension(filepath.Ext(c.Path()))
 				if contentType == "" {contentType = "text/plain"}
 
-				pagevars := PageVars{ Url:c.BaseURL()+c.OriginalURL(), Ctx: c, Now: time.Now().Unix() }
+				pagevars := PageVars{ Url:c.BaseURL()+c.OriginalURL(), Ctx: c, Now: time.Now().Unix(), User: getUser(c) }
 
 				buf := new(bytes.Buffer)
-				c.Response().Header.Add("Content-Type", contentType)
-
-				err := soloTemplates[soloPath].Execute(buf, pagevars)
-				if err!=nil {fmt.Println(err); return c.Status(500).SendString(err.Error())};
+				err := getTier(c).Template(soloTemplates[soloPath]).Execute(buf, pagevars)
+				if err!=nil { log.Printf("Template Error: %s: %v", soloPath, err); return sendError(c, 500, nil) };
 
+				c.Response().Header.Add("Content-Type", contentType)
 				return c.Send(buf.Bytes());
 			}
 			// Else, return not found error.
-			return c.SendStatus(404)
+			return sendError(c, 404, nil)
 		}
 
 		if len(soloLimits[soloPath]) == 2 {
 			expr := soloLimits[soloPath][0]; maximum := soloLimits[soloPath][1]
-			limit := limiter.New(limiter.Config{Expiration:time.Duration(expr)*time.Second, Max:maximum})
+			limit := limiter.New(limiter.Config{Expiration:time.Duration(expr)*time.Second, Max:maximum, LimitReached: limitReached})
 			app.Get(soloPath, limit, fiberHander); app.Post(soloPath, limit, fiberHander)
 
 			log.Println("Rate limit is applied for:", soloPath)
@@ -144,91 +155,167 @@ func initRoutes(app *fiber.App) *sql.Stmt {
 		} else { app.Get(soloPath, fiberHander); app.Post(soloPath, fiberHander) }
 	}
 
+	// Serve the built-in JSON API. It can have its own rate limit, given as _api in RATE_LIMIT.
+	if getEnvValue("API") == "true" { initApiRoutes(app, soloLimits[apiPrefix]); delete(soloLimits, apiPrefix) }
+	// Serve the title suggestions for the search boxes. It can have its own rate limit, given as _suggest in RATE_LIMIT.
+	initSuggestRoute(app, soloLimits[suggestPath]); delete(soloLimits, suggestPath)
+
 	// If any soloLimits element is left. It means that solo template for it does not exists.
 	for soloLimit := range soloLimits {log.Println("Solo template for the limit does not exists:",soloLimit)}
 
-	// Only markdown files with public: true metadata and their previewed attachments are served
-	app.Get("/*", func(c *fiber.Ctx) error {
-		urlPath := "/"+c.Params("*");
-		if urlPath=="/"{urlPath += indexPage};
+	// Respond to the request when nothing is served at its path. Defined below.
+	var serveMissing func(c *fiber.Ctx, fallback func() error) error
+
+	// Render the node with its template. If the node is not served, the 404 or the 410 template is used.
+	serveNode := func(c *fiber.Ctx, nodePath string) error {
+		tier := getTier(c)
+		// Prefer the cached node
+		nodeInfo,exists := tier.nodeCache.Get(nodePath)
+		if !exists {
+			nodeInfo,_ = getNodeInfo(nodePath, tier.Full, false);
+			tier.nodeCache.Put(nodePath, nodeInfo) // Add node to the cache.
+		}
 
-		switch filepath.Ext(urlPath) {
-		// If the wanted file is markdown, parse the template and serve if its served.
-		case ".md":
-			// Prefer the cached node
-			nodeInfo,exists := nodeCache.Get(urlPath)
-			if !exists {
-				nodeInfo,_ = getNodeInfo(urlPath, false);
-				nodeCache.Put(urlPath, nodeInfo) // Add node to the cache.
-			}
+		// If the node is not served in the tier or has no content.
+		if !tier.IsServed(&nodeInfo) || nodeInfo.Content == "" {
+			// If the node was served before, it is gone.
+			return serveMissing(c, func() error {
+				var title sql.NullString
+				if err := tier.tombstoneStmt.QueryRow(nodePath).Scan(&title); err == nil {
+					return sendError(c, 410, &Node{File: nodePath, Title: title.String})
+				}
+				return sendError(c, 404, &Node{File: nodePath, Title: nodePath})
+			})
+		}
 
-			// If the node is not public or has no content.
-			if !isServed(nodeInfo.Public) || nodeInfo.Content == "" {
-				if mdTemplates["/mandos/404.html"] != nil {
-					buf := new(bytes.Buffer)
+		// Render the template
+		if nodeTemplate := getNodeTemplate(&nodeInfo); nodeTemplate != nil {
+			buf := new(bytes.Buffer)
 
-					err := mdTemplates["/mandos/404.html"].Execute(buf, PageVars{
-						Url: c.BaseURL()+c.OriginalURL(), Node: &nodeInfo, Ctx: c, Now: time.Now().Unix(),
-					})
-					if err!=nil { fmt.Println(err); return c.Status(500).SendString(err.Error()) };
+			err := tier.Template(nodeTemplate).Execute(buf, PageVars{
+				Url: c.BaseURL()+c.OriginalURL(), Node: &nodeInfo, Ctx: c, User: getUser(c),
+			})
+			if err != nil {
+				log.Printf("Template Error: %s: %v", nodePath, err)
+				return sendError(c, 500, nil)
+			}
+			c.Response().Header.Add("Content-Type", "text/html")
+			return c.Send(buf.Bytes())
 
-					return c.Send(buf.Bytes())
+		}else{log.Println("No template found:", nodePath); return sendError(c, 500, nil)}
+	}
 
-				} else {
-					nodeInfo = Node{
-						Title: "404 Not Found", Content: "<p>404 node does not exist.</p><p><a href=\"/\">Return To Index</a></p>",
-					}
+	// Serve the non-markdown file if a node links to it.
+	serveAttachment := func(c *fiber.Ctx, urlPath string) error {
+		// Sanitize the user given urlPath.
+		absPath := SafeJoin(notesPath, urlPath)
+		if absPath==""{return serveMissing(c, nil)}
+		// If it is a hidden file, do not show it.
+		if strings.HasPrefix(filepath.Base(absPath), ".") {return serveMissing(c, nil)}
+
+		if !noAttCheck {
+			tier := getTier(c)
+			// Prefer the cached attachment existence value.
+			_, exists := tier.attachmentExistenceCache.Get(absPath)
+			if !exists {
+				// Check if at least one node in the tier has a link to the attachment.
+				err := tier.attExistStmt.QueryRow(urlPath).Scan(&urlPath)
+				if err != nil {
+					if err == sql.ErrNoRows { return serveMissing(c, nil) }
+					log.Println("Database error:", err); return sendError(c, 500, nil)
 				}
+				tier.attachmentExistenceCache.Set(absPath, struct{}{}, time.Second*30) // Save to the cache.
 			}
+		}
 
-			c.Response().Header.Add("Content-Type", "text/html")
+		// A linked file can still be missing, or the attachment check can be disabled.
+		if info, err := os.Stat(absPath); err != nil || info.IsDir() {return serveMissing(c, nil)}
 
-			templateName,ok := nodeInfo.Params["template"].(string)
-			if !ok || templateName == "" {templateName = "main.html"}
-			templateRelPath := strings.TrimPrefix(filepath.Join(getEnvValue("MD_TEMPLATES"),templateName), notesPath)
+		// If we reach here, the attachment is found.
+		c.Response().Header.Add("Cache-Control", "max-age=604800")
+		return c.SendFile(absPath)
+	}
 
-			// Render the template
-			if mdTemplates[templateRelPath] != nil {
-				buf := new(bytes.Buffer)
+	// Serve the node or the attachment at the URL path.
+	servePath := func(c *fiber.Ctx, urlPath string) error {
+		if prettyUrls {
+			nodePath := getPrettyUrlNode(urlPath)
+			if nodePath == "" {return serveAttachment(c, urlPath)}
 
-				err := mdTemplates[templateRelPath].Execute(buf, PageVars{
-					Url: c.BaseURL()+c.OriginalURL(), Node: &nodeInfo, Ctx: c,
+			// Redirect to the canonical URL of the node. For example, /note.md to /note and /folder/index to /folder/
+			if canonical := PrettyUrl(nodePath); canonical != urlPath { return c.Redirect(appendQuery(c, canonical), 301) }
+
+			// If the folder has no index node, list its nodes with the listing template.
+			if listing := getMdTemplate("listing.html"); listing != nil && urlPath != "/" && !FileExists(nodePath) && isFolder(urlPath) {
+				c.Response().Header.Add("Content-Type", "text/html")
+				buf := new(bytes.Buffer)
+				err := getTier(c).Template(listing).Execute(buf, PageVars{
+					Url: c.BaseURL()+c.OriginalURL(), Node: &Node{File: urlPath, Title: urlPath}, Ctx: c, Now: time.Now().Unix(), User: getUser(c),
 				})
-				if err != nil {
-					log.Printf("Template Error: %v", err)
-					return c.Status(500).SendString(err.Error())
-				}
+				if err != nil { log.Printf("Template Error: %s: %v", urlPath, err); return sendError(c, 500, nil) }
 				return c.Send(buf.Bytes())
+			}
 
-			}else{return c.SendString("No template found")}
+			return serveNode(c, nodePath)
+		}
+
+		if urlPath=="/"{urlPath += indexPage};
 
+		// If the wanted file is markdown, parse the template and serve if its served.
+		if filepath.Ext(urlPath) == ".md" {return serveNode(c, urlPath)}
 		// If the wanted file is not markdown
-		default:
-			// Sanitize the user given urlPath.
-			absPath := SafeJoin(notesPath, urlPath)
-			if absPath==""{return c.SendStatus(404)}
-			// If it is a hidden file, do not show it.
-			if strings.HasPrefix(filepath.Base(absPath), ".") {return c.SendStatus(404)} 
-
-			if !noAttCheck {
-				// Prefer the cached attachment existence value.
-				_, exists := attachmentExistenceCache.Get(absPath)
-				if !exists {
-					// Check if at least one node has a link to the attachment.
-					err := attExistStmt.QueryRow(urlPath).Scan(&urlPath)
-					if err != nil {
-						if err == sql.ErrNoRows { return c.SendStatus(404) }
-						log.Println("Database error:", err); return c.SendStatus(500)
-					}
-					attachmentExistenceCache.Set(absPath, struct{}{}, time.Second*30) // Save to the cache.
-				}
-			}
+		return serveAttachment(c, urlPath)
+	}
 
-			// If we reach here, the attachment is found.
-			c.Response().Header.Add("Cache-Control", "max-age=604800")
-			return c.SendFile(absPath)
+	// The redirect rules that are not forced and the aliases are only applied if nothing is served at the path, so they do not
+	// shadow the nodes and the files. If none matches, the fallback responds, or 404 if it is nil.
+	serveMissing = func(c *fiber.Ctx, fallback func() error) error {
+		if fallback == nil { fallback = func() error {return sendError(c, 404, nil)} }
+		// The path served instead by a 200 rule is not redirected again.
+		if c.Locals("rewritten") != nil {return fallback()}
+
+		urlPath := "/"+c.Params("*")
+		if to, status, ok := findRedirect(urlPath, false); ok {return applyRedirect(c, to, status, servePath)}
+		for _,alias := range getAliasCandidates(urlPath) {
+			var to string
+			if err := getTier(c).aliasStmt.QueryRow(alias).Scan(&to); err == nil { return c.Redirect(appendQuery(c, PrettyUrl(to)), 301) }
 		}
+		return fallback()
+	}
+
+	// Only markdown files with public: true metadata and their previewed attachments are served
+	app.Get("/*", func(c *fiber.Ctx) error {
+		urlPath := "/"+c.Params("*");
+
+		// The forced redirect rules are applied before the nodes and the attachments.
+		if to, status, ok := findRedirect(urlPath, true); ok {return applyRedirect(c, to, status, servePath)}
+		return servePath(c, urlPath)
 	})
+}
 
-	return attExistStmt
+// Respond with the redirect rule. 200 serves the to path instead, the redirect statuses redirect to it, and the others send the error page.
+func applyRedirect(c *fiber.Ctx, to string, status int, servePath func(c *fiber.Ctx, urlPath string) error) error {
+	switch {
+	case status == 200: c.Locals("rewritten", true); return servePath(c, to)
+	case status >= 300 && status < 400: return c.Redirect(appendQuery(c, to), status)
+	default: return sendError(c, status, nil)
+	}
+}
+
+// Add the query string of the request to the redirect target, if it does not have one.
+func appendQuery(c *fiber.Ctx, to string) string {
+	if query := c.Request().URI().QueryString(); len(query) != 0 && !strings.Contains(to, "?") { return to+"?"+string(query) }
+	return to
+}
+
+// Get the markdown template given in the "template" metadata field of the node. If it is not given, main.html is used.
+func getNodeTemplate(nodeInfo *Node) Template {
+	templateName,ok := nodeInfo.Params["template"].(string)
+	if !ok || templateName == "" {templateName = "main.html"}
+	return getMdTemplate(templateName)
+}
+// Get the markdown template by its file name in the MD_TEMPLATES folder.
+func getMdTemplate(templateName string) Template {
+	templateRelPath := strings.TrimPrefix(filepath.Join(getEnvValue("MD_TEMPLATES"),templateName), notesPath)
+	return mdTemplates[templateRelPath]
 }
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"database/sql"; "fmt"; "os"; "path/filepath"
+)
+
+// The schema of the databases is versioned with PRAGMA user_version. The migration at index i upgrades the schema from version i to i+1,
+// and every database runs the migrations it has not run yet, in order. Add the new migrations to the end, and never change the old ones.
+// Older versions did not set user_version, so the first migrations also upgrade their tables if they have an older shape.
+// If a migration changes the data derived from the node files, like adding a column to nodes, it marks the nodes stale with markNodesStale.
+var migrations = []func(tx *sql.Tx) error{
+	migrateBaseTables,
+	migrateParamTypes,
+	migrateHeadings,
+	migrateSuggestions,
+	migrateMeta,
+}
+
+// The settings that change the derived data in the databases. Their values are kept in the meta table, so only the derived data
+// that depends on a changed setting is rebuilt. (See syncSettings)
+var indexSettings = map[string]func() string{
+	"content_search": func() string {return getEnvValue("CONTENT_SEARCH")},
+	"section_search": func() string {return getEnvValue("SECTION_SEARCH")},
+	"fts_config": func() string {return ftsIndexConfig(getEnvValue("FTS_TOKENIZER"), getFtsColumns(), ftsStoresContent())},
+}
+
+// The values of the settings that older versions kept in the marker files of the cache folder. They are used for the databases
+// that have no settings in their meta table yet. (See importLegacyMarkers)
+var legacySettings = make(map[string]string)
+
+// Read the marker files of the older versions into legacySettings. A missing marker is the value of the older versions
+// without that setting: the search indexes were disabled, and the FTS index used the default tokenizer without extra columns and stored content.
+func importLegacyMarkers(cacheDir string) {
+	for _,key := range []string{"content_search", "section_search"} {
+		legacySettings[key] = "false"
+		if _,err := os.Stat(filepath.Join(cacheDir, key)); err == nil { legacySettings[key] = "true" }
+	}
+	// The fts_config marker was empty if no index was created.
+	legacySettings["fts_config"] = ftsIndexConfig(defaultFtsTokenizer, nil, false)
+	if value, err := os.ReadFile(filepath.Join(cacheDir, "fts_config")); err == nil && len(value) != 0 { legacySettings["fts_config"] = string(value) }
+}
+
+// Remove the marker files of the older versions. It is called after the databases of all tiers are migrated,
+// so the markers are still read on the next start if a migration fails.
+func removeLegacyMarkers(cacheDir string) {
+	for _,key := range []string{"only_public", "content_search", "section_search", "fts_config"} { os.Remove(filepath.Join(cacheDir, key)) }
+}
+
+// Run the migrations the database has not run yet, and sync the settings, in a single transaction.
+// full is true for the database of the tier with the private nodes and the excluded lines. (See syncSettings)
+func migrate(db *sql.DB, full bool) error {
+	tx, err := db.Begin()
+	if err != nil { return err }
+	defer tx.Rollback()
+
+	var version int
+	if err = tx.QueryRow(`PRAGMA user_version;`).Scan(&version); err != nil { return err }
+	if version > len(migrations) {
+		return fmt.Errorf("the database has schema version %d, but this version of mandos only knows %d. Delete the databases in CACHE_FOLDER to regenerate them", version, len(migrations))
+	}
+	for ; version < len(migrations); version++ {
+		if err = migrations[version](tx); err != nil { return fmt.Errorf("migration %d failed: %w", version+1, err) }
+		// PRAGMA does not take placeholders.
+		if _, err = tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d;`, version+1)); err != nil { return err }
+	}
+
+	if err = syncSettings(tx, full); err != nil { return err }
+	// The tier is checked when the database is opened. (See databaseTier)
+	if _, err = tx.Exec(`INSERT OR REPLACE INTO meta (key, value) VALUES ('tier', ?)`, tierName(full)); err != nil { return err }
+	return tx.Commit()
+}
+
+// The name of the tier in the meta table. The full tier has the private nodes and the excluded lines.
+func tierName(full bool) string {
+	if full {return "full"}
+	return "public"
+}
+
+// Make initialSync upsert all the nodes again, without deleting them first. Their mtimes never match the files.
+func markNodesStale(tx *sql.Tx) error {
+	_, err := tx.Exec(`UPDATE nodes SET mtime = -1;`)
+	return err
+}
+
+func tableExists(tx *sql.Tx, name string) (exists bool, err error) {
+	err = tx.QueryRow(`SELECT COUNT(*) > 0 FROM sqlite_master WHERE type = 'table' AND name = ?`, name).Scan(&exists)
+	return exists, err
+}
+
+// 1: The nodes, their links and attachments, aliases, schedule and tombstones.
+func migrateBaseTables(tx *sql.Tx) error {
+	// Nodes: file is text (filepath), mtime as INTEGER, date as INTEGER (unix seconds), title TEXT
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS nodes (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		file TEXT UNIQUE,
+		mtime INTEGER NOT NULL,
+		date  INTEGER,
+		title TEXT
+	);
+	CREATE INDEX IF NOT EXISTS idx_node_file ON nodes(file);
+	CREATE INDEX IF NOT EXISTS idx_node_date ON nodes(date);
+	`)
+	if err != nil { return err }
+
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS outlinks (
+		"from" TEXT NOT NULL,
+		"to"   TEXT NOT NULL,
+		PRIMARY KEY ("from", "to"),
+		FOREIGN KEY ("from") REFERENCES nodes(file) ON DELETE CASCADE
+	) WITHOUT ROWID;
+	CREATE INDEX IF NOT EXISTS idx_outlink_to ON outlinks("to");
+	`)
+	if err != nil { return err }
+
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS attachments (
+		"from" TEXT NOT NULL,
+		file TEXT NOT NULL,
+		PRIMARY KEY ("from", file)
+		FOREIGN KEY ("from") REFERENCES nodes(file) ON DELETE CASCADE
+	) WITHOUT ROWID;
+	CREATE INDEX IF NOT EXISTS idx_attachment_file ON attachments(file);
+	`)
+	if err != nil { return err }
+
+	// Aliases: old paths of the nodes that are redirected to them.
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS aliases (
+		alias TEXT PRIMARY KEY,
+		"to"  TEXT NOT NULL,
+		FOREIGN KEY ("to") REFERENCES nodes(file) ON DELETE CASCADE
+	) WITHOUT ROWID;
+	CREATE INDEX IF NOT EXISTS idx_alias_to ON aliases("to");
+	`)
+	if err != nil { return err }
+
+	// Schedule: the expiry times of the served nodes, so they are expired even if the server was down at that time.
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS schedule (
+		file TEXT PRIMARY KEY,
+		at   INTEGER NOT NULL,
+		FOREIGN KEY (file) REFERENCES nodes(file) ON DELETE CASCADE
+	) WITHOUT ROWID;
+	`)
+	if err != nil { return err }
+
+	// Tombstones: the nodes that were served, but are deleted or unpublished. They are answered with 410 Gone.
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS tombstones (
+		file    TEXT PRIMARY KEY,
+		title   TEXT,
+		reason  TEXT NOT NULL,
+		deleted INTEGER NOT NULL
+	) WITHOUT ROWID;
+	CREATE INDEX IF NOT EXISTS idx_tombstone_deleted ON tombstones(deleted);
+	`)
+	return err
+}
+
+// 2: The params with their types. Older versions stored the params as texts without their types, so they are rebuilt.
+func migrateParamTypes(tx *sql.Tx) error {
+	var hasType bool
+	if err := tx.QueryRow(`SELECT COUNT(*) > 0 FROM pragma_table_info('params') WHERE name = 'type'`).Scan(&hasType); err != nil { return err }
+	hasParams, err := tableExists(tx, "params")
+	if err != nil { return err }
+	if hasParams && !hasType {
+		if _, err = tx.Exec(`DROP TABLE params;`); err != nil { return err }
+		if err = markNodesStale(tx); err != nil { return err }
+	}
+
+	// Params: one row per (from, key, value, type). Unique constraint prevents duplicates.
+	// The value has no type, so the numbers are stored as numbers. The type is string, int, float, bool or date.
+	// Booleans are stored as 1 and 0, and dates as unix epochs, so the type keeps true and 1 apart.
+	// The nested keys are joined with dots, like author.name
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS params (
+		"from"  TEXT NOT NULL,
+		key   TEXT NOT NULL,
+		value NOT NULL,
+		type  TEXT NOT NULL,
+		PRIMARY KEY ("from", key, value, type)
+		FOREIGN KEY ("from") REFERENCES nodes(file) ON DELETE CASCADE
+	) WITHOUT ROWID;
+	CREATE INDEX IF NOT EXISTS idx_params_key_val_from ON params(key, value, "from");
+	CREATE INDEX IF NOT EXISTS idx_params_from ON params("from");
+	`)
+	return err
+}
+
+// 3: The headings of the nodes in order, with their anchors in the rendered HTML,
+// and the anchors used in the links to the nodes, like "section" in /note.md#section.
+func migrateHeadings(tx *sql.Tx) error {
+	hasHeadings, err := tableExists(tx, "headings")
+	if err != nil { return err }
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS headings (
+		file     TEXT NOT NULL,
+		position INTEGER NOT NULL,
+		level    INTEGER NOT NULL,
+		text     TEXT NOT NULL,
+		anchor   TEXT NOT NULL,
+		PRIMARY KEY (file, position),
+		FOREIGN KEY (file) REFERENCES nodes(file) ON DELETE CASCADE
+	) WITHOUT ROWID;
+	CREATE INDEX IF NOT EXISTS idx_heading_file_anchor ON headings(file, anchor);
+
+	CREATE TABLE IF NOT EXISTS link_fragments (
+		"from"   TEXT NOT NULL,
+		"to"     TEXT NOT NULL,
+		fragment TEXT NOT NULL,
+		PRIMARY KEY ("from", "to", fragment),
+		FOREIGN KEY ("from") REFERENCES nodes(file) ON DELETE CASCADE
+	) WITHOUT ROWID;
+	CREATE INDEX IF NOT EXISTS idx_link_fragment_to ON link_fragments("to", fragment);
+	`)
+	if err != nil { return err }
+	if !hasHeadings { return markNodesStale(tx) }
+	return nil
+}
+
+// 4: The titles, aliases and file names of the nodes, and their trigrams for SuggestTitles.
+func migrateSuggestions(tx *sql.Tx) error {
+	hasSuggestions, err := tableExists(tx, "suggestions")
+	if err != nil { return err }
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS suggestions (
+		id       INTEGER PRIMARY KEY AUTOINCREMENT,
+		file     TEXT NOT NULL,
+		text     TEXT NOT NULL,
+		kind     TEXT NOT NULL,
+		trigrams INTEGER NOT NULL,
+		FOREIGN KEY (file) REFERENCES nodes(file) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_suggestion_file ON suggestions(file);
+
+	CREATE TABLE IF NOT EXISTS suggestion_trigrams (
+		trigram TEXT NOT NULL,
+		id      INTEGER NOT NULL,
+		PRIMARY KEY (trigram, id),
+		FOREIGN KEY (id) REFERENCES suggestions(id) ON DELETE CASCADE
+	) WITHOUT ROWID;
+	CREATE INDEX IF NOT EXISTS idx_suggestion_trigram_id ON suggestion_trigrams(id);
+	`)
+	if err != nil { return err }
+	if !hasSuggestions { return markNodesStale(tx) }
+	return nil
+}
+
+// 5: The settings the derived data is built with.
+func migrateMeta(tx *sql.Tx) error {
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS meta (
+		key   TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	) WITHOUT ROWID;
+	`)
+	return err
+}
+
+// Compare the settings with the ones the derived data is built with, and rebuild only the FTS tables that depend on the changed ones.
+// The disabled indexes are dropped. The new indexes are filled from the files of the nodes in the database, and the other tables are kept.
+// The nodes modified since are upserted by initialSync later, like the other modified nodes.
+func syncSettings(tx *sql.Tx, full bool) error {
+	old := make(map[string]string)
+	for key := range indexSettings {
+		var value string
+		err := tx.QueryRow(`SELECT value FROM meta WHERE key = ?`, key).Scan(&value)
+		if err == sql.ErrNoRows {
+			// The databases of the older versions were built with the settings in the marker files.
+			// An empty database has nothing to rebuild, so any value works for it.
+			value = legacySettings[key]
+		} else if err != nil { return err }
+		old[key] = value
+	}
+
+	ftsChanged := old["fts_config"] != indexSettings["fts_config"]()
+	var refillContent, refillSections bool
+	// Tell why the nodes are indexed again, if the database already has nodes.
+	var hasNodes bool
+	if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM nodes)`).Scan(&hasNodes); err != nil { return err }
+	printChange := func(key string, enabled bool, table string) {
+		if !hasNodes {return}
+		if enabled { fmt.Printf("%s is enabled. The nodes will be indexed in %s.\n", key, table)
+		} else { fmt.Printf("The FTS settings have changed. %s will be rebuilt.\n", table) }
+	}
+
+	// The content index of the nodes.
+	contentSearch := getEnvValue("CONTENT_SEARCH") == "true"
+	if old["content_search"] == "true" && (!contentSearch || ftsChanged) {
+		if _, err := tx.Exec(`DROP TRIGGER IF EXISTS nodes_ad; DROP TABLE IF EXISTS nodes_fts;`); err != nil { return err }
+	}
+	if contentSearch {
+		if old["content_search"] != "true" || ftsChanged { refillContent = true; printChange("CONTENT_SEARCH", old["content_search"] != "true", "nodes_fts") }
+		// The metadata fields in FTS_COLUMNS are indexed in the extra columns.
+		columns := "title, content"
+		for _,key := range getFtsColumns() { columns += ", "+ftsColumnName(key) }
+		_, err := tx.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS nodes_fts USING fts5(
+			`+columns+`,
+			`+ftsContentOption()+`
+			`+ftsTokenizeOption()+`
+		);`)
+		if err != nil { return fmt.Errorf("nodes_fts could not be created, check FTS_TOKENIZER: %w", err) }
+		// ORDER BY rank uses the weights in FTS_WEIGHTS.
+		_, err = tx.Exec(`INSERT INTO nodes_fts(nodes_fts, rank) VALUES('rank', ?)`, ftsRank(getFtsWeights()))
+		if err != nil { return err }
+		// Sync On Delete (Like ON DELETE CASCADE)
+		_, err = tx.Exec(`CREATE TRIGGER IF NOT EXISTS nodes_ad AFTER DELETE ON nodes BEGIN
+  			DELETE FROM nodes_fts WHERE rowid = old.id;
+		END;`)
+		if err != nil { return err }
+		// We first delete, then insert. No need for update sync.
+	}
+
+	// The sections of the nodes and their FTS5 index, for linking the search results to the headings.
+	sectionSearch := getEnvValue("SECTION_SEARCH") == "true"
+	if old["section_search"] == "true" && (!sectionSearch || ftsChanged) {
+		if _, err := tx.Exec(`DROP TRIGGER IF EXISTS sections_ad; DROP TABLE IF EXISTS sections_fts; DROP TABLE IF EXISTS sections;`); err != nil { return err }
+	}
+	if sectionSearch {
+		if old["section_search"] != "true" || ftsChanged { refillSections = true; printChange("SECTION_SEARCH", old["section_search"] != "true", "sections_fts") }
+		_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS sections (
+			id      INTEGER PRIMARY KEY AUTOINCREMENT,
+			file    TEXT NOT NULL,
+			anchor  TEXT NOT NULL,
+			heading TEXT NOT NULL,
+			FOREIGN KEY (file) REFERENCES nodes(file) ON DELETE CASCADE
+		);
+		CREATE INDEX IF NOT EXISTS idx_section_file ON sections(file);
+
+		CREATE VIRTUAL TABLE IF NOT EXISTS sections_fts USING fts5(
+			heading, content,
+			`+ftsContentOption()+`
+			`+ftsTokenizeOption()+`
+		);`)
+		if err != nil { return fmt.Errorf("sections_fts could not be created, check FTS_TOKENIZER: %w", err) }
+		// The headings weigh like the titles.
+		_, err = tx.Exec(`INSERT INTO sections_fts(sections_fts, rank) VALUES('rank', ?)`, ftsRank(getFtsWeights()[:2]))
+		if err != nil { return err }
+		// The sections are deleted with their nodes, and the trigger deletes their index.
+		_, err = tx.Exec(`CREATE TRIGGER IF NOT EXISTS sections_ad AFTER DELETE ON sections BEGIN
+			DELETE FROM sections_fts WHERE rowid = old.id;
+		END;`)
+		if err != nil { return err }
+	}
+
+	if hasNodes && (refillContent || refillSections) {
+		if err := refillIndexes(tx, full, refillContent, refillSections); err != nil { return err }
+	}
+	for key, value := range indexSettings {
+		if _, err := tx.Exec(`INSERT OR REPLACE INTO meta (key, value) VALUES (?, ?)`, key, value()); err != nil { return err }
+	}
+	return nil
+}
+
+// Fill the new content index and the sections from the files of the nodes in the database. The files that cannot be read are skipped,
+// initialSync deletes them.
+func refillIndexes(tx *sql.Tx, full, contentSearch, sectionSearch bool) error {
+	rows, err := tx.Query(`SELECT id, file FROM nodes;`)
+	if err != nil { return err }
+	ids := make(map[string]int64)
+	for rows.Next() {
+		var id int64; var file string
+		if err := rows.Scan(&id, &file); err != nil { rows.Close(); return err }
+		ids[file] = id
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil { return err }
+
+	stmtIndex := prepareIndexStmts(tx, contentSearch, sectionSearch)
+	defer stmtIndex.Close()
+	for file, id := range ids {
+		node, err := getNodeInfo(file, full, false)
+		if err != nil {continue}
+		stmtIndex.insert(id, &node)
+	}
+	return nil
+}
@@ -1,86 +1,107 @@
 package main
 
 import (
-	"bytes"; "fmt"; "os"; "path/filepath"; "strings"; "time"; "regexp"; "unicode/utf8"
-	"gopkg.in/yaml.v3";
+	"bytes"; "fmt"; "html"; htmlTemplate "html/template"; "net/url"; "os"; "path/filepath"; "strings"; "time"; "unicode/utf8"
 )
 // Key is the relative file location starting with slash, considering notesPath as root.
 type Node struct {
 	File string // The same with the key. Only used in templates, otherwise empty.
 	Public bool // Is the file is public?
-	Title string // The last H1 heading or the "title" metadata field.
+	Title string // The first H1 heading or the "title" metadata field.
 	Date int64 // the date metadata field.
+	PublishAt int64 // the publish_at metadata field. The node is not served before it. Zero if not given.
+	Expires int64 // the expires metadata field. The node is not served after it. Zero if not given.
 	Content string // Raw markdown content. Only used in templates.
-	Params map[string]any // Fields in the YAML metadata part, except the title, public, and date. Must be []string or string
+	Params map[string]any // Fields in the metadata part, except the title, public, and date. The values keep their types.
 	OutLinks []string // The list of nodes this node links to. (Their .File values)
+	LinkFragments map[string][]string // The fragments of the links to the nodes, like "section" in /note.md#section. key: .File of the linked node
 	Attachments []string // Local non-markdown links in a node.
+	Aliases []string // Old paths of the node in the "aliases" metadata field. They are redirected to the node.
+	Headings []Heading // The headings in the content, in order.
 }
 
-var mdLinkRe = regexp.MustCompile(`\]\(/([^)?#]*)[^)]*\)`) // Extract internal markdown links. Do not capture after ? or #
-var htmlSrcRe = regexp.MustCompile(`<[^>]+src="/([^"?#]+)[^>]`) // Extract internal html links inside src. Do not capture after ? or #
-func getNodeInfo(relPath string, onlyContent bool) (nodeinfo Node, err error) {
+// A heading of a node. ID is its anchor in the rendered HTML.
+type Heading struct {
+	Level int
+	Text string
+	ID string
+	line, endLine int // The first and the last lines of the heading in the content. The empty headings have -1.
+}
+
+// If full is true, the lines marked with <!--exc--> are not excluded.
+func getNodeInfo(relPath string, full, onlyContent bool) (nodeinfo Node, err error) {
 
 	absPath := SafeJoin(notesPath, relPath)
 	if absPath==""{return nodeinfo,err}
 
 	data, err := os.ReadFile(absPath); if err != nil {return nodeinfo, err};
 
-	var inMeta bool
 	var inExcBlock bool
-	var metaBuf bytes.Buffer
 	var contentBuf bytes.Buffer
 	var linkMap = make(map[string]struct{})
+	var hasUnresolved bool // If the node has wikilinks whose targets do not exist.
 	nodeinfo.Title = relPath
-	var gotTitle bool
 
 	nodeinfo.File = relPath
 
-	for line := range bytes.SplitSeq(data, []byte("\n")) {
-		// Exclude lines if ONLY_PUBLIC != "no"
-		if onlyPublic != "no" {
-			if !inExcBlock && bytes.Contains(line, []byte("<!--exc:start-->")){inExcBlock=true; continue}
-			if inExcBlock && bytes.Contains(line, []byte("<!--exc:end-->")){inExcBlock=false; continue}
-			if inExcBlock || bytes.Contains(line, []byte("<!--exc-->")){continue}
-		}
-
-		// Run the link finding regexp if the line contains "](" or "src="
-		if !onlyContent && bytes.Contains(line, []byte("](")){
-			for _,match := range mdLinkRe.FindAllSubmatch(line,-1) {
-				// The link should start with a slash and the link path must consider notesPath as root. It should not be an absolute path or relative path inside the file system.
-				linkMap[filepath.Join("/", string(match[1]))] = struct{}{}
-			}
-		}
-		if !onlyContent && bytes.Contains(line, []byte("src=")) {
-			for _,match := range htmlSrcRe.FindAllSubmatch(line,-1) {
-				// The link should start with a slash and the link path must consider notesPath as root. It should not be an absolute path or relative path inside the file system.
-				linkMap[filepath.Join("/", string(match[1]))] = struct{}{}
-			}
-		}
+	// The metadata block is not a part of the content.
+	meta, metaFormat, body, metaLine := splitFrontmatter(data)
 
-		// Extract the metadata if the file starts with "---" (YAML metadata block)
-		if contentBuf.Len()==0 && bytes.Equal(line, []byte("---")) && !inMeta { inMeta = true; continue }
-		if inMeta {
-			// If its end of the metadata, stop extracting.
-			if bytes.Equal(line, []byte("---")) { inMeta = false; continue }
-
-			// Otherwise, write the line to the buffer.
-			if !onlyContent { metaBuf.Write(line); metaBuf.WriteByte('\n') }
+	// Exclude lines if the tier is not full.
+	var excMarkers map[int]int
+	if !full { excMarkers = findExclusionMarkers(body) }
 
+	lineNum := -1
+	for line := range bytes.SplitSeq(body, []byte("\n")) {
+		lineNum++
+		if marker := excMarkers[lineNum]; marker != 0 || inExcBlock {
+			if !inExcBlock && marker&excStart != 0 {inExcBlock=true; continue}
+			if inExcBlock && marker&excEnd != 0 {inExcBlock=false; continue}
 			continue
 		}
 
-		// Extract the title
-		if !onlyContent && !gotTitle && bytes.HasPrefix(line, []byte("# ")){
-			nodeinfo.Title = strings.TrimPrefix(string(line), "# "); gotTitle = true;
-		}
-
 		// Write the lines to the content buffer
 		contentBuf.Write(line)
-        contentBuf.WriteByte('\n')
+		contentBuf.WriteByte('\n')
+	}
+
+	// Extract the title, the headings and the links from the markdown AST, so the ones in the code blocks are ignored.
+	if !onlyContent {
+		var fragmentMap = make(map[[2]string]struct{}) // [linked node, fragment]
+		addFragment := func(file, fragment string) {
+			if fragment == "" || !strings.HasSuffix(file, ".md") {return}
+			if unescaped, err := url.PathUnescape(fragment); err == nil { fragment = unescaped }
+			fragmentMap[[2]string{file, fragment}] = struct{}{}
+		}
+		addLink := func(link string) {
+			// Absolute links consider notesPath as root. Relative links are resolved against the directory of the node.
+			// Do not use the parts after ? or #
+			link, fragment, _ := strings.Cut(link, "#")
+			if i := strings.IndexByte(link, '?'); i >= 0 { link = link[:i] }
+			// The links like #section point to the node itself.
+			if link == "" { addFragment(relPath, fragment); return }
+			if link,ok := resolveNodeLink(relPath, link); ok { linkMap[link] = struct{}{}; addFragment(link, fragment) }
+		}
+		addWikiLink := func(target, fragment string) {
+			// The wikilink fragments are the heading texts. They are converted to anchors like WikiLinks does.
+			fragment = string(Slugify([]byte(fragment), '-'))
+			// [[#Heading]] links to the node itself.
+			if target == "" { addFragment(relPath, fragment); return }
+			if file,ok := wikiLinks.Resolve(target); ok { linkMap[file] = struct{}{}; addFragment(file, fragment) } else { hasUnresolved = true }
+		}
+		scanNodeContent(contentBuf.Bytes(), &nodeinfo, addLink, addWikiLink)
+
+		for key := range fragmentMap {
+			if nodeinfo.LinkFragments == nil { nodeinfo.LinkFragments = make(map[string][]string) }
+			nodeinfo.LinkFragments[key[0]] = append(nodeinfo.LinkFragments[key[0]], key[1])
+		}
 	}
 
 	nodeinfo.Content = strings.TrimSuffix(contentBuf.String(), "\n")
 
+	// The widest tier sees all the wikilinks of the node.
+	if !onlyContent && (full || memberTier == nil) { wikiLinks.SetUnresolved(relPath, hasUnresolved) }
+
 	// Add the links to the fileinfo.Attachments or fileinfo.Outlinks (Only if they exist in the filesystem)
 	for link := range linkMap{
 		// If its a markdown file, add to the outlinks.
@@ -91,18 +112,31 @@ func getNodeInfo(relPath string, onlyContent bool) (nodeinfo Node, err error) {
 		} else { nodeinfo.Attachments = append(nodeinfo.Attachments, link) }
 	}
 
-	// Parse the YAML metadata to fileinfo.Params
-    if metaBuf.Len() != 0 {
-        if err := yaml.Unmarshal(metaBuf.Bytes(), &nodeinfo.Params); err != nil {
-            return nodeinfo, fmt.Errorf("%s: %w", relPath, err)
-        }
-    }
+	// Parse the YAML, TOML or JSON metadata to fileinfo.Params
+	if !onlyContent && metaFormat != "" {
+		if nodeinfo.Params, err = parseFrontmatter(relPath, meta, metaFormat, metaLine); err != nil {return nodeinfo, err}
+	}
 
 	if !onlyContent {
 		// Get the public field in the metadata
 		if isPublic,ok := nodeinfo.Params["public"].(bool); ok && isPublic {nodeinfo.Public = isPublic; delete(nodeinfo.Params, "public")}
 		// Get the date of the node from the metadata
 		if yamlDate,ok := nodeinfo.Params["date"].(time.Time); ok {nodeinfo.Date=yamlDate.Unix(); delete(nodeinfo.Params,"date")}
+		// Get the publishing window of the node. An invalid date must not publish the node early, so it is an error.
+		for key, field := range map[string]*int64{"publish_at": &nodeinfo.PublishAt, "expires": &nodeinfo.Expires} {
+			value, exists := nodeinfo.Params[key]
+			if !exists {continue}
+			yamlDate, ok := value.(time.Time)
+			if !ok {return nodeinfo, fmt.Errorf("%s: %s must be a date, got %v", relPath, key, value)}
+			*field = yamlDate.Unix(); delete(nodeinfo.Params, key)
+		}
+		// Get the old paths of the node. A single alias can also be given as a string.
+		switch aliases := nodeinfo.Params["aliases"].(type) {
+		case string: nodeinfo.Aliases = []string{filepath.Join("/", aliases)}; delete(nodeinfo.Params, "aliases")
+		case []any:
+			for _,alias := range aliases { if a,ok := alias.(string); ok && a != "" { nodeinfo.Aliases = append(nodeinfo.Aliases, filepath.Join("/", a)) } }
+			delete(nodeinfo.Params, "aliases")
+		}
 		// Prefer the metadata title over the first header
 		if mTitle,ok := nodeinfo.Params["title"].(string); ok && mTitle != "" { nodeinfo.Title = mTitle; delete(nodeinfo.Params,"title") }
 	}
@@ -110,47 +144,31 @@ func getNodeInfo(relPath string, onlyContent bool) (nodeinfo Node, err error) {
 	return nodeinfo, nil
 }
 
-func GetNodeContent(relPath string) string {
-	// Prefer cache.
-	nodeinfo, exists := nodeCache.Get(relPath)
-	if !exists {
-		var err error
-		nodeinfo, err = getNodeInfo(relPath, true)
-		if err != nil {return err.Error()}
-		nodeCache.Put(relPath, nodeinfo) // Cache the node to the memory.
-	}
-	return nodeinfo.Content
+// If the node is within its publishing window at the given unix time.
+func (n *Node) IsLive(now int64) bool {
+	return (n.PublishAt == 0 || now >= n.PublishAt) && (n.Expires == 0 || now < n.Expires)
 }
 
-var fts5Query = regexp.MustCompile(`"([^"]+)"|(\w+)`)
+// The next time the node will be published or expired. Zero if there is no upcoming transition.
+func (n *Node) NextTransition(now int64) int64 {
+	if n.PublishAt > now {return n.PublishAt}
+	if n.Expires > now {return n.Expires}
+	return 0
+}
+
+// Get the content of the node as the default tier sees it.
+func GetNodeContent(relPath string) string { return defaultTier.GetNodeContent(relPath) }
+
 // GetContentMatch extracts a highlighted snippet from content. 
 // It looks for a line containing the most query tokens. If a line contains all tokens, 
 // it returns a windowed snippet around the match. Otherwise, it falls back to 
 // the best partial match found. It handles UTF-8 safely and avoids per-line allocations.
-func GetContentMatch(content string, searchQuery string, window int) string {
+// The tokens are the terms of the query as ParseSearch reads it, so the excluded words are not highlighted.
+// The snippet is escaped, and only the match is wrapped in <b>, so it is safe HTML.
+func GetContentMatch(content string, searchQuery string, window int) htmlTemplate.HTML {
 	if content == "" || searchQuery == "" { return "" }
 
-	// Pre-process tokens
-	matches := fts5Query.FindAllStringSubmatch(searchQuery, -1)
-	var uniqueTokens []string
-
-	seen := make(map[string]bool)
-	// m[1] is the string between quotes, and m[2] is the unquoted word.
-	for _, m := range matches {
-		term := m[1] 
-		// If m[1] is an empty string, it means that the unquoted word (m[2]) is matched.
-		if term == "" {
-			term = m[2]
-			if len(term) < 3 { continue } // Skip the term if its too short.
-		}
-		// If the term has already seen, or its one of the FTS5 query operation strings, skip it.
-		if term == "AND" || term == "OR" || term == "NOT" || seen[term] { continue }
-
-		term = strings.ToLower(term)
-		seen[term] = true
-
-		uniqueTokens = append(uniqueTokens, term)
-	}
+	uniqueTokens := ParseSearch(searchQuery).Terms
 
 	if len(uniqueTokens) == 0 { return "" }
 
@@ -221,9 +239,9 @@ func GetContentMatch(content string, searchQuery string, window int) string {
 	// We slice the rune array and convert only that small segment to a string.
 	snippetRunes := runes[startBound:endBound]
 	
-	return fmt.Sprintf("...%s<b>%s</b>%s...",
-		string(snippetRunes[:relMatchStart]),
-		string(snippetRunes[relMatchStart:relMatchEnd]),
-		string(snippetRunes[relMatchEnd:]),
-	)
+	return htmlTemplate.HTML(fmt.Sprintf("...%s<b>%s</b>%s...",
+		html.EscapeString(string(snippetRunes[:relMatchStart])),
+		html.EscapeString(string(snippetRunes[relMatchStart:relMatchEnd])),
+		html.EscapeString(string(snippetRunes[relMatchEnd:])),
+	))
 }
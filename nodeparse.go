@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"; "regexp"; "strings"
+
+	"github.com/mdigger/goldmark-attributes"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+	"github.com/zenarvus/goldmark-headingid"
+	"github.com/zenarvus/goldmark-mathjax"
+)
+
+// Parses the nodes like htmlConverter, but without the extensions that change the AST for rendering.
+// (RelativeLinks rewrites the links and the raw HTML, and BetterMedia replaces the images.)
+var nodeParser = goldmark.New(
+	attributes.Enable,
+	goldmark.WithExtensions(extension.GFM, extension.Footnote, mathjax.MathJax, WikiLinks),
+	goldmark.WithParserOptions(parser.WithAttribute(), parser.WithAutoHeadingID()),
+).Parser()
+
+// The heading IDs are generated like in ToHtml, so they match the anchors in the rendered nodes.
+func parseMarkdown(source []byte) ast.Node {
+	ctx := parser.NewContext(parser.WithIDs(headingid.NewIDs()))
+	return nodeParser.Parse(text.NewReader(source), parser.WithContext(ctx))
+}
+
+// Bit flags of the exclusion markers in a line.
+const (
+	excLine = 1 << iota
+	excStart
+	excEnd
+)
+
+// Find the lines of the body that contain exclusion markers. The markers only count as raw HTML, so a marker in a code block
+// or a code span is a part of the content.
+func findExclusionMarkers(body []byte) map[int]int {
+	markers := make(map[int]int)
+	if !bytes.Contains(body, []byte("<!--exc")) {return markers}
+
+	addMarkers := func(segment text.Segment) {
+		value := segment.Value(body)
+		line := bytes.Count(body[:segment.Start], []byte("\n"))
+		if bytes.Contains(value, []byte("<!--exc-->")) { markers[line] |= excLine }
+		if bytes.Contains(value, []byte("<!--exc:start-->")) { markers[line] |= excStart }
+		if bytes.Contains(value, []byte("<!--exc:end-->")) { markers[line] |= excEnd }
+	}
+	ast.Walk(parseMarkdown(body), func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {return ast.WalkContinue, nil}
+		switch v := n.(type) {
+		case *ast.RawHTML:
+			for i := 0; i < v.Segments.Len(); i++ { addMarkers(v.Segments.At(i)) }
+		case *ast.HTMLBlock:
+			for i := 0; i < v.Lines().Len(); i++ { addMarkers(v.Lines().At(i)) }
+			if v.HasClosure() { addMarkers(v.ClosureLine) }
+		}
+		return ast.WalkContinue, nil
+	})
+	return markers
+}
+
+// The attributes of the raw HTML elements that link to the other files. ToHtml rewrites the same attributes. (See relativeLinkTransformer)
+var htmlLinkRe = regexp.MustCompile(`\s(href|src|srcset|poster)\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+
+// Extract the title, the headings and the local links of the node from its content. The title is the text of the first top level H1 heading that is not empty.
+// addLink is called with the links as they are written, and addWikiLink with the targets and the fragments of the wikilinks.
+// The code blocks and the code spans are skipped.
+func scanNodeContent(content []byte, node *Node, addLink func(link string), addWikiLink func(target, fragment string)) {
+	var gotTitle bool
+	addHtmlLinks := func(html []byte) {
+		for _,match := range htmlLinkRe.FindAllSubmatch(html, -1) {
+			value := string(match[2]) + string(match[3])
+			if strings.EqualFold(string(match[1]), "srcset") {
+				// Like "/small.png 480w, /large.png 1080w"
+				for candidate := range strings.SplitSeq(value, ",") {
+					if fields := strings.Fields(candidate); len(fields) != 0 { addLink(fields[0]) }
+				}
+			} else { addLink(value) }
+		}
+	}
+
+	// The end of the last block with lines, to find the empty ATX headings, which have no lines.
+	var lastBlockEnd int
+	ast.Walk(parseMarkdown(content), func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {return ast.WalkContinue, nil}
+		if n.Type() == ast.TypeBlock && n.Lines().Len() > 0 { lastBlockEnd = max(lastBlockEnd, n.Lines().At(n.Lines().Len()-1).Stop) }
+		switch v := n.(type) {
+		case *ast.CodeBlock, *ast.FencedCodeBlock, *ast.CodeSpan: return ast.WalkSkipChildren, nil
+		case *ast.Heading:
+			text := nodeText(v, content)
+			id, _ := v.AttributeString("id")
+			idBytes, _ := id.([]byte)
+			heading := Heading{Level: v.Level, Text: text, ID: string(idBytes), line: -1, endLine: -1}
+			if lines := v.Lines(); lines.Len() > 0 {
+				first, last := lines.At(0), lines.At(lines.Len()-1)
+				heading.line = bytes.Count(content[:first.Start], []byte("\n"))
+				heading.endLine = bytes.Count(content[:last.Start], []byte("\n"))
+				// The ATX headings start with #, and the setext headings are underlined in the next line.
+				if !bytes.ContainsRune(content[bytes.LastIndexByte(content[:first.Start], '\n')+1:first.Start], '#') { heading.endLine++ }
+			} else if line := emptyHeadingLine(content, lastBlockEnd); line != -1 {
+				// An empty heading like "#" is the first line with a # after the previous block.
+				heading.line, heading.endLine = line, line
+			}
+			node.Headings = append(node.Headings, heading)
+			// The empty H1s are skipped, so the title is the next H1 or the file path.
+			if !gotTitle && v.Level == 1 && v.Parent().Kind() == ast.KindDocument && strings.TrimSpace(text) != "" { node.Title, gotTitle = text, true }
+		case *ast.Link: addLink(string(v.Destination))
+		case *ast.Image: addLink(string(v.Destination))
+		case *WikiLink: addWikiLink(string(v.Target), string(v.Fragment))
+		case *ast.RawHTML:
+			addHtmlLinks(v.Segments.Value(content))
+		case *ast.HTMLBlock:
+			addHtmlLinks(v.Lines().Value(content))
+			if closure := v.ClosureLine; v.HasClosure() { addHtmlLinks(closure.Value(content)) }
+		}
+		return ast.WalkContinue, nil
+	})
+}
+
+// The line of the first ATX heading after the line that contains the offset, or -1. The heading can be in a block quote or a list item.
+func emptyHeadingLine(content []byte, offset int) int {
+	var start int
+	if offset > 0 {
+		newline := bytes.IndexByte(content[offset-1:], '\n'); if newline == -1 {return -1}
+		start = offset + newline
+	}
+	line := bytes.Count(content[:start], []byte("\n"))
+	for text := range bytes.SplitAfterSeq(content[start:], []byte("\n")) {
+		if bytes.HasPrefix(bytes.TrimLeft(text, " \t>-*+0123456789.)"), []byte("#")) {return line}
+		line++
+	}
+	return -1
+}
+
+// The plain text of an inline container, like a heading. The markup and the raw HTML are dropped.
+func nodeText(n ast.Node, source []byte) string {
+	var buf strings.Builder
+	ast.Walk(n, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {return ast.WalkContinue, nil}
+		switch v := n.(type) {
+		case *ast.Text:
+			buf.Write(v.Value(source))
+			if v.SoftLineBreak() || v.HardLineBreak() { buf.WriteByte(' ') }
+		case *ast.String: buf.Write(v.Value)
+		case *WikiLink: buf.Write(v.Label); return ast.WalkSkipChildren, nil
+		}
+		return ast.WalkContinue, nil
+	})
+	return strings.TrimSpace(buf.String())
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"; "fmt"; htmlTemplate "html/template"; "io/fs"; "log"; "path/filepath"; "strings"; "text/template"; "text/template/parse"
+)
+
+// The partials that cannot be included, because they are in an include cycle or include a partial by a variable name.
+// key: relative path of the partial, value: the reason
+var partialErrors = make(map[string]error)
+
+// The partials folder in the templates folder, considering notesPath as root.
+func getPartialsPath() string {
+	return strings.TrimPrefix(filepath.Join(getEnvValue("MD_TEMPLATES"), "partials"), notesPath)
+}
+
+// Get the relative path of the partial from its name, like "nav/menu.html".
+func getPartialPath(partialName string) string {return filepath.Join(getPartialsPath(), partialName)}
+
+// If the file is in the partials folder or its subfolders.
+func isPartialPath(relPath string) bool {return strings.HasPrefix(relPath, getPartialsPath()+"/")}
+
+// Load the partials in the partials folder and its subfolders.
+func loadPartials() {
+	partialTemplates = make(map[string]Template)
+	root := filepath.Join(notesPath, getPartialsPath())
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {return err}
+		if d.IsDir() {return nil}
+		relPath := strings.TrimPrefix(path, notesPath)
+		t, err := readTemplateFile(relPath, "partial")
+		if err != nil {log.Println(err)} else {partialTemplates[relPath] = t}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {log.Fatal(err)}
+	checkPartials()
+}
+
+// Call the function for every Include call in the template and the templates defined in it.
+func walkIncludes(templ Template, visit func(cmd *parse.CommandNode)) {
+	var trees []*parse.Tree
+	switch v := templ.(type) {
+	case *template.Template: for _,t := range v.Templates() { trees = append(trees, t.Tree) }
+	case *htmlTemplate.Template: for _,t := range v.Templates() { trees = append(trees, t.Tree) }
+	}
+	for _,tree := range trees { if tree != nil { walkNode(tree.Root, visit) } }
+}
+
+func walkNode(node parse.Node, visit func(cmd *parse.CommandNode)) {
+	switch n := node.(type) {
+	case *parse.ListNode: if n != nil { for _,child := range n.Nodes { walkNode(child, visit) } }
+	case *parse.ActionNode: walkNode(n.Pipe, visit)
+	case *parse.IfNode: walkNode(n.Pipe, visit); walkNode(n.List, visit); walkNode(n.ElseList, visit)
+	case *parse.RangeNode: walkNode(n.Pipe, visit); walkNode(n.List, visit); walkNode(n.ElseList, visit)
+	case *parse.WithNode: walkNode(n.Pipe, visit); walkNode(n.List, visit); walkNode(n.ElseList, visit)
+	case *parse.TemplateNode: walkNode(n.Pipe, visit)
+	case *parse.ChainNode: walkNode(n.Node, visit)
+	case *parse.PipeNode:
+		if n == nil {return}
+		for _,cmd := range n.Cmds {
+			if ident, ok := cmd.Args[0].(*parse.IdentifierNode); ok && ident.Ident == "Include" { visit(cmd) }
+			for _,arg := range cmd.Args { walkNode(arg, visit) }
+		}
+	}
+}
+
+// Pass the dot of the caller to the partials that are included without data, so {{Include "x.html"}} is {{Include "x.html" .}}
+func defaultIncludeData(templ Template) {
+	walkIncludes(templ, func(cmd *parse.CommandNode) {
+		if len(cmd.Args) == 2 { cmd.Args = append(cmd.Args, &parse.DotNode{NodeType: parse.NodeDot, Pos: cmd.Args[0].Position()}) }
+	})
+}
+
+// Find the include cycles between the partials. The partials must include the other partials by their names, not variables,
+// so every cycle is found before the partials are executed.
+func checkPartials() {
+	errs := make(map[string]error)
+	includes := make(map[string][]string)
+	for relPath, partial := range partialTemplates {
+		walkIncludes(partial, func(cmd *parse.CommandNode) {
+			var name *parse.StringNode
+			if len(cmd.Args) >= 2 { name, _ = cmd.Args[1].(*parse.StringNode) }
+			if name == nil {
+				errs[relPath] = fmt.Errorf("partials must include the other partials by their names: %s", cmd)
+				return
+			}
+			includes[relPath] = append(includes[relPath], getPartialPath(name.Text))
+		})
+	}
+
+	// Depth-first search. The partials in the current path are visiting; if one of them is reached again, there is a cycle.
+	const visiting, visited = 1, 2
+	state := make(map[string]int)
+	var stack []string
+	var visit func(relPath string)
+	visit = func(relPath string) {
+		state[relPath] = visiting
+		stack = append(stack, relPath)
+		for _,included := range includes[relPath] {
+			switch state[included] {
+			case visiting:
+				i := len(stack)-1
+				for stack[i] != included { i-- }
+				cycle := fmt.Errorf("include cycle: %s -> %s", strings.Join(stack[i:], " -> "), included)
+				for _,p := range stack[i:] { errs[p] = cycle }
+			case 0: visit(included)
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[relPath] = visited
+	}
+	for relPath := range partialTemplates { if state[relPath] == 0 { visit(relPath) } }
+
+	for relPath, err := range errs { log.Println("Partial cannot be included:", relPath, err) }
+	partialErrors = errs
+}
@@ -0,0 +1,45 @@
+package main
+
+import ("os"; "path"; "strings")
+
+// Serve the nodes without the .md extension, and the folders with their index.md nodes.
+var prettyUrls bool
+
+// Convert the node path to its pretty URL, if PRETTY_URLS is enabled. Otherwise, return it unchanged.
+// For example, /note.md becomes /note, /folder/index.md becomes /folder/ and the INDEX node becomes /
+// Relative paths are also converted, so sibling.md becomes sibling and index.md becomes ./
+func PrettyUrl(nodePath string) string {
+	if !prettyUrls || !strings.HasSuffix(nodePath, ".md") {return nodePath}
+	if nodePath == path.Join("/", indexPage) {return "/"}
+
+	if nodePath == "index.md" {return "./"}
+	if path.Base(nodePath) == "index.md" {return strings.TrimSuffix(nodePath, "index.md")}
+	return strings.TrimSuffix(nodePath, ".md")
+}
+
+// Get the node path the pretty URL points to. An empty string is returned if the URL is for an attachment.
+func getPrettyUrlNode(urlPath string) string {
+	switch {
+	case urlPath == "/": return path.Join("/", indexPage)
+	case strings.HasSuffix(urlPath, ".md"): return urlPath
+	case strings.HasSuffix(urlPath, "/"): return urlPath+"index.md"
+	case FileExists(urlPath+".md"): return urlPath+".md"
+	// A folder without the trailing slash.
+	case isFolder(urlPath): return urlPath+"/index.md"
+	}
+	return ""
+}
+
+// If the request path is for a node. In the pretty URL mode, the paths without an extension and the folders are also nodes.
+func isNodeRequest(urlPath string) bool {
+	if strings.HasSuffix(urlPath, ".md") {return true}
+	return prettyUrls && (strings.HasSuffix(urlPath, "/") || path.Ext(urlPath) == "")
+}
+
+// Check if the path is a non-hidden folder in MD_FOLDER.
+func isFolder(relPath string) bool {
+	absPath := SafeJoin(notesPath, relPath)
+	if absPath == "" || strings.HasPrefix(path.Base(absPath), ".") {return false}
+	info, err := os.Stat(absPath)
+	return err == nil && info.IsDir()
+}
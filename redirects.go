@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"; "bytes"; "fmt"; "log"; "os"; "path/filepath"; "strconv"; "strings"; "sync"
+)
+
+// A rule in the _redirects file, in the Netlify format: "/from /to [status][!]"
+// The from path can contain :placeholders as segments and end with a * wildcard. They can be used in the to path, the wildcard as :splat
+type RedirectRule struct {
+	From []string // The segments of the from path.
+	To string
+	Status int // 301, 302, 303, 307 and 308 redirect, 200 serves the to path instead, and the others respond with the status.
+	Force bool // If the rule is applied even if a node or a file is served at the from path. Given with ! after the status.
+}
+
+var redirectRules []RedirectRule
+var redirectRulesMu sync.RWMutex
+
+// The _redirects file in the templates folder, considering notesPath as root.
+func getRedirectsPath() string {
+	return strings.TrimPrefix(filepath.Join(getEnvValue("MD_TEMPLATES"), "_redirects"), notesPath)
+}
+
+// Load the redirect rules from the _redirects file. If it does not exist, there are no rules.
+func loadRedirects() {
+	data, err := os.ReadFile(filepath.Join(notesPath, getRedirectsPath()))
+	if err != nil && !os.IsNotExist(err) {log.Println("Redirects file could not be read:", err)}
+
+	var rules []RedirectRule
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		rule, err := parseRedirectRule(scanner.Text())
+		if err != nil {log.Printf("%s:%d: %v", getRedirectsPath(), lineNum, err); continue}
+		if rule != nil { rules = append(rules, *rule) }
+	}
+
+	redirectRulesMu.Lock(); redirectRules = rules; redirectRulesMu.Unlock()
+	if len(rules) != 0 { fmt.Println(len(rules), "redirect rules are loaded.") }
+}
+
+// Parse a line of the _redirects file. Empty lines and comments return nil.
+func parseRedirectRule(line string) (*RedirectRule, error) {
+	if i := strings.Index(line, "#"); i >= 0 { line = line[:i] }
+	fields := strings.Fields(line)
+	if len(fields) == 0 {return nil, nil}
+	if len(fields) < 2 || len(fields) > 3 {return nil, fmt.Errorf("malformed redirect rule: %q", line)}
+	// The to path can be omitted if the rule only responds with a status, like "/gone 410"
+	if _,err := strconv.Atoi(fields[1]); err == nil && len(fields) == 2 { fields = []string{fields[0], "", fields[1]} }
+
+	rule := &RedirectRule{From: strings.Split(strings.Trim(fields[0], "/"), "/"), To: fields[1], Status: 301}
+	if len(fields) == 3 {
+		status, err := strconv.Atoi(strings.TrimSuffix(fields[2], "!"))
+		if err != nil || status < 200 || status > 599 {return nil, fmt.Errorf("invalid redirect status: %q", fields[2])}
+		rule.Status, rule.Force = status, strings.HasSuffix(fields[2], "!")
+	}
+	if rule.To == "" && rule.Status < 400 {return nil, fmt.Errorf("the to path must be given for the status %d", rule.Status)}
+	if rule.Status == 200 && !strings.HasPrefix(rule.To, "/") {return nil, fmt.Errorf("only local paths can be served with 200: %q", rule.To)}
+	for i, segment := range rule.From {
+		if segment == "*" && i != len(rule.From)-1 {return nil, fmt.Errorf("the wildcard must be at the end: %q", fields[0])}
+	}
+	return rule, nil
+}
+
+// Match the URL path with the rule, and return the to path with the placeholders replaced.
+func (rule *RedirectRule) Match(urlPath string) (string, bool) {
+	segments := strings.Split(strings.Trim(urlPath, "/"), "/")
+	var replacements []string
+
+	for i, from := range rule.From {
+		if from == "*" {
+			replacements = append(replacements, ":splat", strings.Join(segments[min(i, len(segments)):], "/"))
+			return strings.NewReplacer(replacements...).Replace(rule.To), true
+		}
+		if i >= len(segments) {return "", false}
+		if strings.HasPrefix(from, ":") { replacements = append(replacements, from, segments[i]); continue }
+		if from != segments[i] {return "", false}
+	}
+	if len(segments) != len(rule.From) {return "", false}
+
+	return strings.NewReplacer(replacements...).Replace(rule.To), true
+}
+
+// Find the first forced or unforced redirect rule that matches the URL path.
+func findRedirect(urlPath string, force bool) (to string, status int, ok bool) {
+	redirectRulesMu.RLock()
+	defer redirectRulesMu.RUnlock()
+
+	for _, rule := range redirectRules {
+		if rule.Force != force {continue}
+		if to, ok := rule.Match(urlPath); ok {return to, rule.Status, true}
+	}
+	return "", 0, false
+}
+
+// Get the paths an alias can be stored as for the URL path. For example, in the pretty URL mode, /old-note can be the alias /old-note.md
+func getAliasCandidates(urlPath string) []string {
+	trimmed := filepath.Join("/", urlPath)
+	candidates := []string{trimmed}
+	if prettyUrls && filepath.Ext(trimmed) == "" { candidates = append(candidates, trimmed+".md", filepath.Join(trimmed, "index.md")) }
+	return candidates
+}
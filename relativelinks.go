@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"; "path/filepath"; "regexp"; "strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+var urlSchemeRe = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]*:`)
+
+// Resolve a link in the node to a path that considers notesPath as root. Relative links are resolved against the directory
+// of the node. External links (with a scheme like https: or mailto:, or starting with //) and empty links are ignored.
+// The link must not contain the query or the fragment part.
+func resolveNodeLink(nodePath, link string) (string, bool) {
+	if link == "" || strings.HasPrefix(link, "//") || urlSchemeRe.MatchString(link) {return "", false}
+	if strings.HasPrefix(link, "/") {return filepath.Join("/", link), true}
+	return filepath.Join("/", filepath.Dir(nodePath), link), true
+}
+
+// Rewrite a local link in the node, keeping its query and fragment parts. If the node path is given, relative links are
+// resolved to absolute ones. If PRETTY_URLS is enabled, the links to the nodes are converted to pretty URLs.
+func rewriteLocalLink(nodePath string, link []byte) []byte {
+	if len(link) == 0 || link[0] == '?' || link[0] == '#' {return link}
+	end := bytes.IndexAny(link, "?#")
+	if end < 0 { end = len(link) }
+
+	linkPath := string(link[:end])
+	if strings.HasPrefix(linkPath, "//") || urlSchemeRe.MatchString(linkPath) {return link}
+	if nodePath != "" && !strings.HasPrefix(linkPath, "/") { linkPath, _ = resolveNodeLink(nodePath, linkPath) }
+	return append([]byte(PrettyUrl(linkPath)), link[end:]...)
+}
+
+var nodePathKey = parser.NewContextKey()
+
+// Rewrite the URLs of the candidates in a srcset value, like "small.png 480w, large.png 1080w", with rewriteLocalLink.
+func rewriteSrcset(nodePath string, srcset []byte) []byte {
+	candidates := bytes.Split(srcset, []byte(","))
+	for i, candidate := range candidates {
+		start := len(candidate) - len(bytes.TrimLeft(candidate, " \t\n"))
+		end := bytes.IndexAny(candidate[start:], " \t\n")
+		if end < 0 { end = len(candidate) } else { end += start }
+		candidates[i] = bytes.Join([][]byte{candidate[:start], rewriteLocalLink(nodePath, candidate[start:end]), candidate[end:]}, nil)
+	}
+	return bytes.Join(candidates, []byte(","))
+}
+
+// Rewrites the local links, images and the link attributes in raw HTML with rewriteLocalLink. The attributes are the ones
+// in htmlLinkRe, so the links tracked as outlinks and attachments are also rewritten. Relative links become absolute, so the
+// rendered content works on any page. The node path is given with the nodePathKey in the parser context.
+type relativeLinkTransformer struct{}
+
+func (t relativeLinkTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	nodePath, _ := pc.Get(nodePathKey).(string)
+	if nodePath == "" && !prettyUrls {return}
+	source := reader.Source()
+
+	// Only the values of the attributes are replaced, so their quotes are kept.
+	rewriteHtml := func(html []byte) (rewritten []byte) {
+		var last int
+		for _,m := range htmlLinkRe.FindAllSubmatchIndex(html, -1) {
+			start, end := m[4], m[5] // The value in double quotes, or in single quotes.
+			if start < 0 { start, end = m[6], m[7] }
+			value := html[start:end]
+			if strings.EqualFold(string(html[m[2]:m[3]]), "srcset") { value = rewriteSrcset(nodePath, value) } else { value = rewriteLocalLink(nodePath, value) }
+			rewritten = append(append(rewritten, html[last:start]...), value...)
+			last = end
+		}
+		return append(rewritten, html[last:]...)
+	}
+
+	// Raw HTML nodes point to the source, so they are replaced with strings after the walk.
+	// The strings are marked as code, because only code strings are written without escaping.
+	var oldNodes, newNodes []ast.Node
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {return ast.WalkContinue, nil}
+		switch v := n.(type) {
+		case *ast.Link: v.Destination = rewriteLocalLink(nodePath, v.Destination)
+		case *ast.Image: v.Destination = rewriteLocalLink(nodePath, v.Destination)
+		case *ast.RawHTML:
+			html := v.Segments.Value(source)
+			if rewritten := rewriteHtml(html); !bytes.Equal(html, rewritten) {
+				str := ast.NewString(rewritten); str.SetCode(true)
+				oldNodes = append(oldNodes, v); newNodes = append(newNodes, str)
+			}
+		case *ast.HTMLBlock:
+			html := v.Lines().Value(source)
+			if v.HasClosure() { html = append(html, v.ClosureLine.Value(source)...) }
+			if rewritten := rewriteHtml(html); !bytes.Equal(html, rewritten) {
+				str := ast.NewString(rewritten); str.SetCode(true)
+				block := ast.NewTextBlock(); block.AppendChild(block, str)
+				oldNodes = append(oldNodes, v); newNodes = append(newNodes, block)
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+	for i, old := range oldNodes { old.Parent().ReplaceChild(old.Parent(), old, newNodes[i]) }
+}
+
+type relativeLinkExtension struct{}
+
+// RelativeLinks resolves the relative links against the node given in the parser context, and converts the node links to pretty URLs.
+var RelativeLinks = &relativeLinkExtension{}
+
+func (e *relativeLinkExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(parser.WithASTTransformers(util.Prioritized(relativeLinkTransformer{}, 999)))
+}
@@ -0,0 +1,58 @@
+package main
+
+import ("log"; "os"; "sync"; "time")
+
+// The timers of the nodes that will be published or expired. key: path of the node, value: the timer and its unix time
+// Only the earliest transition of a node is scheduled. When it fires, the node is upserted again, which schedules the next one.
+var transitionTimers = make(map[string]scheduledTransition)
+var transitionTimersMu sync.Mutex
+
+type scheduledTransition struct { timer *time.Timer; at int64 }
+
+// Upsert the node at the given unix time, so it is added to or removed from the databases exactly when its publishing window changes.
+func scheduleTransition(file string, at int64) {
+	transitionTimersMu.Lock()
+	defer transitionTimersMu.Unlock()
+
+	if existing, ok := transitionTimers[file]; ok {
+		if existing.at <= at {return} // The earlier transition will schedule this one.
+		existing.timer.Stop()
+	}
+	timer := time.AfterFunc(time.Until(time.Unix(at, 0)), func() {
+		transitionTimersMu.Lock(); delete(transitionTimers, file); transitionTimersMu.Unlock()
+		runTransitions([]string{file})
+	})
+	transitionTimers[file] = scheduledTransition{timer: timer, at: at}
+}
+
+// Upsert the nodes whose publishing window has changed, and clear the query caches so the templates see them immediately.
+func runTransitions(files []string) {
+	nodes := make(map[string]int64)
+	for _,file := range files {
+		fileInfo, err := os.Stat(SafeJoin(notesPath, file))
+		if err != nil {continue} // The node is deleted.
+		nodes[file] = fileInfo.ModTime().Unix()
+	}
+	if len(nodes) == 0 {return}
+
+	upsertNodes(nodes)
+	for _,t := range tiers { t.queryCache.Clear() }
+	log.Println(len(nodes), "node(s) are published or expired.")
+}
+
+// Schedule the transitions stored in the database of the tier. The nodes whose transition time passed while the server was down are upserted.
+func (t *Tier) loadSchedule() {
+	rows, err := t.DB.Query(`SELECT file, at FROM schedule;`)
+	if err != nil {log.Println("Schedule could not be loaded:", err); return}
+
+	var passed []string
+	now := time.Now().Unix()
+	for rows.Next() {
+		var file string; var at int64
+		if err := rows.Scan(&file, &at); err != nil {log.Println(err); continue}
+		if at <= now { passed = append(passed, file) } else { scheduleTransition(file, at) }
+	}
+	rows.Close()
+
+	runTransitions(passed)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"regexp"; "strings"; "time"
+)
+
+// A search query of a visitor, translated to a valid FTS5 expression and SQL filters.
+type SearchQuery struct {
+	Match string // The FTS5 expression for MATCH. Empty if the query has no search terms.
+	Terms []string // The lowercase words and phrases to highlight. The excluded and the short words are not included.
+	Filters string // The SQL conditions of the filters for the nodes table aliased as n. "1" if there are no filters.
+	Values []any // The Match and the values of the filters, in the order of the placeholders in "MATCH ? AND Filters".
+}
+
+// A phrase in quotes, or a word. Both can start with - to be excluded. The closing quote can be missing.
+var searchTokenRe = regexp.MustCompile(`(-?)(?:"([^"]*)"?|(\S+))`)
+
+// Quote the text as a FTS5 string, so its characters are never read as operators.
+func quoteFts(text string) string { return `"` + strings.ReplaceAll(text, `"`, `""`) + `"` }
+
+// Translate the search input to a FTS5 expression. Anything can be given, the result is always valid.
+//  - Words are searched together, and "quoted phrases" are searched as they are.
+//  - -word, -"phrase" and NOT word exclude the nodes that contain them.
+//  - word* searches the words starting with it.
+//  - tag:foo only searches the nodes with the tag, and -tag:foo excludes them.
+//  - after:2024-01-01 and before:2024-01-01 only search the nodes with a date in the range.
+// AND and OR are ignored, unless the query has nothing else. The other FTS5 syntax is searched as text.
+func ParseSearch(input string) (query SearchQuery) {
+	var include, exclude, conditions, operators []string
+	var filterValues []any
+	seen := make(map[string]bool)
+	notPending := false
+
+	addTerm := func(term string, excluded bool) {
+		term = strings.ToLower(term)
+		if excluded || seen[term] {return}
+		seen[term] = true
+		query.Terms = append(query.Terms, term)
+	}
+
+	for _,m := range searchTokenRe.FindAllStringSubmatchIndex(input, -1) {
+		excluded := m[3] > m[2] || notPending
+		notPending = false
+
+		// A quoted phrase.
+		if m[4] >= 0 {
+			phrase := strings.Join(strings.Fields(input[m[4]:m[5]]), " ")
+			if phrase == "" {continue}
+			if excluded { exclude = append(exclude, quoteFts(phrase)) } else { include = append(include, quoteFts(phrase)) }
+			addTerm(phrase, excluded)
+			continue
+		}
+
+		word := input[m[6]:m[7]]
+		if m[3] == m[2] {
+			switch word {
+			case "AND", "OR": operators = append(operators, word); continue
+			case "NOT": operators = append(operators, word); notPending = true; continue
+			}
+		}
+
+		if key, value, ok := strings.Cut(word, ":"); ok && value != "" {
+			switch strings.ToLower(key) {
+			case "tag":
+				condition := `EXISTS (SELECT 1 FROM params p WHERE p."from" = n.file AND p.key = 'tags' AND p.value = ?)`
+				if excluded { condition = "NOT "+condition }
+				conditions = append(conditions, condition); filterValues = append(filterValues, value)
+				continue
+			case "after", "before":
+				date, err := time.Parse(time.DateOnly, value)
+				if err != nil || excluded {break}
+				if strings.ToLower(key) == "after" { conditions = append(conditions, "n.date >= ?") } else { conditions = append(conditions, "n.date < ?") }
+				filterValues = append(filterValues, date.Unix())
+				continue
+			}
+		}
+
+		prefix := strings.HasSuffix(word, "*")
+		word = strings.TrimRight(word, "*")
+		if word == "" {continue}
+
+		fts := quoteFts(word)
+		if prefix { fts += "*" }
+		if excluded { exclude = append(exclude, fts) } else { include = append(include, fts) }
+		// The short words match too many parts of the content to be highlighted.
+		if len(word) >= 3 { addTerm(word, excluded) }
+	}
+
+	// If the query only has the operator words, like "AND", they are searched as words.
+	if len(include) == 0 && len(exclude) == 0 {
+		for _,word := range operators { include = append(include, quoteFts(word)); addTerm(word, false) }
+	}
+	// FTS5 cannot search for only the excluded terms.
+	if len(include) != 0 {
+		query.Match = strings.Join(include, " ")
+		if len(exclude) != 0 { query.Match = "("+query.Match+") NOT "+strings.Join(exclude, " NOT ") }
+	}
+
+	query.Filters = "1"
+	if len(conditions) != 0 { query.Filters = strings.Join(conditions, " AND ") }
+	query.Values = append([]any{query.Match}, filterValues...)
+	return query
+}
@@ -0,0 +1,31 @@
+package main
+
+import "strings"
+
+// A part of the node content under a heading, indexed separately if SECTION_SEARCH is true.
+// The part before the first heading has an empty heading and anchor.
+type Section struct {
+	Anchor string
+	Heading string
+	Content string
+}
+
+// Split the content of the node into its sections. Every heading starts a new section, whatever its level is.
+// The part before the first heading is only a section if it is not empty.
+func splitSections(node *Node) (sections []Section) {
+	lines := strings.Split(node.Content, "\n")
+	current := Section{}
+	start := 0
+
+	for _,heading := range node.Headings {
+		if heading.line < start || heading.line >= len(lines) {continue}
+		current.Content = strings.TrimSpace(strings.Join(lines[start:heading.line], "\n"))
+		if current.Anchor != "" || current.Content != "" { sections = append(sections, current) }
+		current = Section{Anchor: heading.ID, Heading: heading.Text}
+		start = min(heading.endLine+1, len(lines))
+	}
+	current.Content = strings.TrimSpace(strings.Join(lines[start:], "\n"))
+	if current.Anchor != "" || current.Content != "" { sections = append(sections, current) }
+
+	return sections
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"log"; "math"; "path"; "sort"; "strings"; "unicode"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// The title suggestions for the search boxes. The titles, the aliases and the file names of the served nodes are split into
+// trigrams in the suggestion_trigrams table, so the nodes are suggested while the words are typed, even with typos.
+
+// A node suggested for the query.
+type Suggestion struct {
+	File string `json:"file"`
+	Url string `json:"url"`
+	Title string `json:"title"`
+	Match string `json:"match"` // The title, alias or file name that matched.
+	Backlinks int `json:"backlinks"`
+	Score float64 `json:"score"`
+}
+
+// Split the text into lowercase words of letters and digits. The common accented letters are replaced like Slugify does.
+func suggestionWords(text string) []string {
+	var normalized strings.Builder
+	for _,r := range strings.ToLower(text) {
+		if s, ok := repl[r]; ok { normalized.WriteString(s); continue }
+		if unicode.IsLetter(r) || unicode.IsDigit(r) { normalized.WriteRune(r) } else { normalized.WriteByte(' ') }
+	}
+	return strings.Fields(normalized.String())
+}
+
+// The unique trigrams of the words in the text. The words are padded like "  word ", so their starts match the typed prefixes.
+func trigrams(text string) (grams []string) {
+	seen := make(map[string]bool)
+	for _,word := range suggestionWords(text) {
+		runes := []rune("  "+word+" ")
+		for i := 0; i+3 <= len(runes); i++ {
+			gram := string(runes[i:i+3])
+			if !seen[gram] { seen[gram] = true; grams = append(grams, gram) }
+		}
+	}
+	return grams
+}
+
+// The texts the node is suggested with, and their kinds: the title, the aliases and the file name.
+func suggestionTexts(node *Node) (texts [][2]string) {
+	texts = append(texts, [2]string{node.Title, "title"})
+	for _,alias := range node.Aliases { texts = append(texts, [2]string{strings.TrimSuffix(path.Base(alias), ".md"), "alias"}) }
+	return append(texts, [2]string{strings.TrimSuffix(path.Base(node.File), ".md"), "file"})
+}
+
+// Suggest the nodes for the query in the default tier.
+func SuggestTitles(query string, limit int) []Suggestion { return defaultTier.SuggestTitles(query, limit) }
+
+// Suggest the nodes whose titles, aliases or file names match the query, the best matches first.
+// The matches that start with the query are preferred, and the nodes with more backlinks rank higher.
+func (t *Tier) SuggestTitles(query string, limit int) []Suggestion {
+	grams := trigrams(query)
+	if len(grams) == 0 || limit < 1 {return []Suggestion{}}
+	normalizedQuery := strings.Join(suggestionWords(query), " ")
+
+	args := make([]any, len(grams))
+	for i, gram := range grams { args[i] = gram }
+	rows, err := t.DB.Query(`SELECT s.file, s.text, s.trigrams, n.title, COUNT(*) AS shared,
+		(SELECT COUNT(*) FROM outlinks o WHERE o."to" = s.file) AS backlinks
+		FROM suggestion_trigrams g JOIN suggestions s ON s.id = g.id JOIN nodes n ON n.file = s.file
+		WHERE g.trigram IN (?`+strings.Repeat(", ?", len(grams)-1)+`)
+		GROUP BY s.id ORDER BY shared DESC LIMIT 500`, args...)
+	if err != nil {log.Println("Suggestion error:", err); return []Suggestion{}}
+	defer rows.Close()
+
+	best := make(map[string]Suggestion)
+	for rows.Next() {
+		var s Suggestion
+		var textTrigrams, shared int
+		if err := rows.Scan(&s.File, &s.Match, &textTrigrams, &s.Title, &shared, &s.Backlinks); err != nil {log.Println("Suggestion error:", err); break}
+
+		// How much of the query is in the text, and how similar they are.
+		coverage := float64(shared)/float64(len(grams))
+		if coverage < 0.4 {continue}
+		s.Score = coverage + 0.3*float64(shared)/float64(len(grams)+textTrigrams-shared)
+
+		normalizedText := strings.Join(suggestionWords(s.Match), " ")
+		if strings.HasPrefix(normalizedText, normalizedQuery) { s.Score += 1
+		} else if strings.Contains(normalizedText, " "+normalizedQuery) { s.Score += 0.75
+		} else if strings.Contains(normalizedText, normalizedQuery) { s.Score += 0.5 }
+		s.Score += math.Log1p(float64(s.Backlinks))/10
+
+		if old, exists := best[s.File]; !exists || s.Score > old.Score { best[s.File] = s }
+	}
+
+	suggestions := make([]Suggestion, 0, len(best))
+	for _,s := range best { s.Url = PrettyUrl(s.File); suggestions = append(suggestions, s) }
+	sort.Slice(suggestions, func(i, j int) bool {
+		if suggestions[i].Score != suggestions[j].Score {return suggestions[i].Score > suggestions[j].Score}
+		return suggestions[i].Title < suggestions[j].Title
+	})
+	return suggestions[:min(limit, len(suggestions))]
+}
+
+// The path of the suggestions endpoint. It is served even if the API is disabled, as the search boxes need it.
+const suggestPath = "/_suggest"
+
+// Register the suggestions endpoint, rate limited like the API if the limit is given.
+func initSuggestRoute(app *fiber.App, limit []int) {
+	app.Get(suggestPath, append(apiLimiter(suggestPath, limit), apiSuggest)...)
+}
+
+// Suggest the nodes for the q query value, for the search boxes. The limit is 10 by default, and can be up to 50.
+func apiSuggest(c *fiber.Ctx) error {
+	return c.JSON(getTier(c).SuggestTitles(c.Query("q"), queryInt(c, "limit", 10, 1, 50)))
+}
@@ -4,15 +4,19 @@ import (
 	"bytes"
 	"fmt"
 	"hash/fnv"
+	htmlTemplate "html/template"
+	"io"
 	"log"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
 	"text/template"
+	"text/template/parse"
 	"time"
 
 	"github.com/mdigger/goldmark-attributes"
@@ -24,6 +28,12 @@ import (
 	"github.com/zenarvus/goldmark-headingid"
 	"github.com/zenarvus/goldmark-mathjax"
 )
+// Templates are compiled with html/template or text/template, depending on their extensions. Both engines use the same functions.
+type Template interface {
+	Execute(wr io.Writer, data any) error
+	Name() string
+}
+
 var templateFuncs = template.FuncMap{
 	"Add":func(x,y int)int{return x+y},
 	"Sub":func(x,y int)int{return x-y},
@@ -31,6 +41,8 @@ var templateFuncs = template.FuncMap{
 	"ToStr":ToStr,
 	"ToInt": ToInt,
 	"ToHtml": ToHtml,
+	"SafeHtml": SafeHtml,
+	"PrettyUrl": PrettyUrl,
 
 	"Query": Query,
 
@@ -42,6 +54,19 @@ var templateFuncs = template.FuncMap{
 
 	"AnyArr":AnySlice,
 
+	"ToJson": ToJson,
+	"ToJsonIndent": ToJsonIndent,
+	"FromJson": FromJson,
+	"Dict": Dict,
+	"List": List,
+	"Append": Append,
+	"Sort": Sort,
+	"Where": Where,
+	"Uniq": Uniq,
+	"First": First,
+	"Last": Last,
+	"Seq": Seq,
+
 	"FormatDateInt": FormatDateInt,
 
 	"HasPrefix": strings.HasPrefix,
@@ -55,7 +80,10 @@ var templateFuncs = template.FuncMap{
 	"IsInt64Valid": IsInt64Valid,
 
 	"GetNodeContent": GetNodeContent,
+	"TOC": TOC,
 	"GetContentMatch": GetContentMatch,
+	"ParseSearch": ParseSearch,
+	"SuggestTitles": SuggestTitles,
 
 	"ReadFile": ReadFile,
 	"WriteFile": WriteFile,
@@ -69,83 +97,169 @@ var templateFuncs = template.FuncMap{
 	"Include":IncludePartial,
 }
 
-var partialTemplates = make(map[string]*template.Template)
-var mdTemplates = make(map[string]*template.Template)
-var soloTemplates = make(map[string]*template.Template)
+var partialTemplates = make(map[string]Template)
+var mdTemplates = make(map[string]Template)
+var soloTemplates = make(map[string]Template)
 //initialize the template file
 func loadAllTemplates(tType string){
 	switch tType{
 	case "md":
-		mdTemplates = make(map[string]*template.Template)
+		mdTemplates = make(map[string]Template)
 		templatesPath := getEnvValue("MD_TEMPLATES")
 		files, err := os.ReadDir(templatesPath); if err != nil {log.Fatal(err)}
 		for _, file := range files {
+			// The redirect rules are not a template.
+			if !file.IsDir() && file.Name() == "_redirects" {continue}
 			if !file.IsDir() { 
 				relPath := strings.TrimPrefix(path.Join(templatesPath, file.Name()), notesPath)
-				t,err := readTemplateFile(relPath)
+				t,err := readTemplateFile(relPath, "md")
 				if err!=nil {log.Println(err)} else {mdTemplates[relPath] = t}
-
-			}else if file.IsDir() && file.Name() == "partials" {
-				partials, err := os.ReadDir(filepath.Join(templatesPath,"partials")); if err != nil {log.Fatal(err)}
-				for _,partial := range partials {
-					relPath := strings.TrimPrefix(path.Join(templatesPath, "partials", partial.Name()), notesPath)
-					t,err := readTemplateFile(relPath)
-					if err!=nil{log.Println(err)} else {partialTemplates[relPath] = t}
-				}
 			}
 		}
+		loadPartials()
 		fmt.Println(len(mdTemplates),"markdown templates are loaded.")
 	case "solo":
 		filesStr:=getEnvValue("SOLO_TEMPLATES"); if filesStr==""{return}
 		for relPath := range strings.SplitSeq(filesStr,",") {
 			relPath = filepath.Join("/",relPath);
-			t,err:=readTemplateFile(relPath)
+			t,err:=readTemplateFile(relPath, "solo")
 			if err!=nil{log.Println(err)} else {soloTemplates[relPath]=t}
 		}
 		fmt.Println(len(soloTemplates),"solo templates are loaded.")
 	}
 }
-func readTemplateFile(relPath string) (*template.Template, error) {
+func readTemplateFile(relPath, tType string) (Template, error) {
 	tmplContent, err := os.ReadFile(filepath.Join(notesPath,relPath)); if err != nil {log.Fatal(err)}
-	templ, err := template.New(relPath).Funcs(templateFuncs).Parse(string(tmplContent)); if err != nil{log.Fatal(err)}
+
+	templ, err := parseTemplate(relPath, string(tmplContent)); if err != nil{log.Fatal(err)}
+
+	// If the template has a layout, the layout is parsed first and the blocks of the template override its blocks.
+	// The partials do not have layouts, they are included in other templates.
+	layout := ""
+	if tType != "partial" { layout = getTemplateLayout(relPath, string(tmplContent), templ) }
+	if layout != "" {
+		layoutContent, err := os.ReadFile(filepath.Join(notesPath,layout))
+		if err != nil {return nil, fmt.Errorf("layout of %s could not be read: %v", relPath, err)}
+		templ, err = parseTemplate(relPath, string(layoutContent), string(tmplContent)); if err != nil{log.Fatal(err)}
+		templateLayouts[relPath] = layout
+	} else { delete(templateLayouts, relPath) }
+
+	defaultIncludeData(templ)
+
+	// The other tiers clone the template with their functions. HTML templates cannot be cloned after they are executed, so clone them now.
+	for _,t := range tiers { t.Template(templ) }
 	return templ, err
 }
+// Parse the contents into the same template. The empty bodies of the later contents do not replace the body of the first one,
+// but their definitions replace the blocks of the earlier ones.
+func parseTemplate(relPath string, contents ...string) (Template, error) {
+	// The HTML templates escape the values by their context, so the user input can be written safely.
+	if isHtmlTemplate(relPath) {
+		templ := htmlTemplate.New(relPath).Funcs(templateFuncs)
+		for _,content := range contents { if _, err := templ.Parse(content); err != nil {return nil, err} }
+		return templ, nil
+	}
+	templ := template.New(relPath).Funcs(templateFuncs)
+	for _,content := range contents { if _, err := templ.Parse(content); err != nil {return nil, err} }
+	return templ, nil
+}
+
+// The layouts of the templates. key: relative path of the template, value: relative path of its layout
+// If a layout changes, the templates that use it are reloaded with it.
+var templateLayouts = make(map[string]string)
+
+// The layout comment at the start of a template, like {{/* layout: post-base.html */}}
+var layoutCommentRe = regexp.MustCompile(`^\s*\{\{-?\s*/\*\s*layout:\s*(\S+)\s*\*/\s*-?\}\}`)
+
+// Get the layout of the template in the MD_TEMPLATES folder, considering notesPath as root. The layout is given by the layout comment,
+// or it is baseof.html if the template only defines blocks and baseof.html exists. "layout: none" disables the layout.
+func getTemplateLayout(relPath, content string, templ Template) string {
+	var layoutName string
+	if match := layoutCommentRe.FindStringSubmatch(content); match != nil {
+		layoutName = match[1]
+	} else if onlyDefinesBlocks(templ) {
+		layoutName = "baseof.html"
+	}
+	if layoutName == "" || layoutName == "none" {return ""}
+
+	layout := strings.TrimPrefix(filepath.Join(getEnvValue("MD_TEMPLATES"), layoutName), notesPath)
+	if layout == relPath {return ""} // A layout cannot be its own layout.
+	if !FileExists(layout) {
+		if match := layoutCommentRe.FindStringSubmatch(content); match != nil {log.Println("Layout does not exists:", relPath, layoutName)}
+		return ""
+	}
+	return layout
+}
+
+// If the template has no body, only {{define}} or {{block}} definitions.
+func onlyDefinesBlocks(templ Template) bool {
+	switch v := templ.(type) {
+	case *template.Template: return len(v.Templates()) > 1 && v.Tree != nil && parse.IsEmptyTree(v.Tree.Root)
+	case *htmlTemplate.Template: return len(v.Templates()) > 1 && v.Tree != nil && parse.IsEmptyTree(v.Tree.Root)
+	}
+	return false
+}
+
+// If the template is compiled with html/template. The extensions are given in HTML_TEMPLATES.
+func isHtmlTemplate(relPath string) bool {
+	for _,ext := range strings.Split(getEnvValue("HTML_TEMPLATES"), ",") {
+		if strings.TrimSpace(ext) == filepath.Ext(relPath) {return true}
+	}
+	return false
+}
+// If the file is directly in the MD_TEMPLATES folder, where the markdown templates and the layouts are.
+func isMdTemplatePath(relPath string) bool {
+	return path.Dir(relPath) == strings.TrimPrefix(getEnvValue("MD_TEMPLATES"), notesPath)
+}
 func loadTemplate(relPath, tType string) {
-	tmpl, err := readTemplateFile(relPath)
+	isNew := tType == "md" && mdTemplates[relPath] == nil
+	setTemplate(relPath, tType)
+
+	// Reload the templates that use this template as their layout, so the set is reloaded as a unit.
+	var dependents []string
+	for dependent, layout := range templateLayouts { if layout == relPath { dependents = append(dependents, dependent) } }
+	// A new template can be the layout of the templates that had none, like baseof.html for the templates that only define blocks.
+	if isNew {
+		for dependent := range mdTemplates { if _,ok := templateLayouts[dependent]; !ok && dependent != relPath { dependents = append(dependents, dependent) } }
+		for dependent := range soloTemplates { if _,ok := templateLayouts[dependent]; !ok { dependents = append(dependents, dependent) } }
+	}
+	for _,dependent := range dependents {
+		if mdTemplates[dependent] != nil { setTemplate(dependent, "md") } else if soloTemplates[dependent] != nil { setTemplate(dependent, "solo") }
+	}
+}
+func setTemplate(relPath, tType string) {
+	tmpl, err := readTemplateFile(relPath, tType)
 	if err != nil {log.Fatal("Template error:",err)}
 	switch tType {
 	case "md": mdTemplates[relPath]=tmpl
 	case "solo": soloTemplates[relPath]=tmpl
-	case "partial": partialTemplates[relPath]=tmpl
+	case "partial": partialTemplates[relPath]=tmpl; checkPartials()
 	}
 }
 
 var htmlConverter = goldmark.New(
 	attributes.Enable,
-	goldmark.WithExtensions(extension.GFM, extension.Footnote, mathjax.MathJax, bettermedia.BetterMedia),
+	goldmark.WithExtensions(extension.GFM, extension.Footnote, mathjax.MathJax, bettermedia.BetterMedia, WikiLinks, RelativeLinks),
 	goldmark.WithParserOptions(parser.WithAttribute(), parser.WithAutoHeadingID()),
 	goldmark.WithRendererOptions(goldmarkHtml.WithHardWraps(), goldmarkHtml.WithXHTML(), goldmarkHtml.WithUnsafe()),
 )
-func ToHtml(mdText string) string {
+// If the node path is given, relative links in the content are rewritten to absolute paths, resolved against the node's directory.
+// The result is marked as safe HTML, so the HTML templates do not escape it.
+func ToHtml(mdText string, nodePath ...string) htmlTemplate.HTML {
 	var html bytes.Buffer
-	if err := htmlConverter.Convert([]byte(mdText), &html, parser.WithContext(parser.NewContext(parser.WithIDs(headingid.NewIDs())))); err != nil {log.Fatal(err)}
-	return html.String()
+	ctx := parser.NewContext(parser.WithIDs(headingid.NewIDs()))
+	if len(nodePath) != 0 { ctx.Set(nodePathKey, nodePath[0]) }
+	if err := htmlConverter.Convert([]byte(mdText), &html, parser.WithContext(ctx)); err != nil {log.Fatal(err)}
+	return htmlTemplate.HTML(html.String())
 }
+// Mark the string as safe HTML, so the HTML templates do not escape it. Only use it for trusted content.
+func SafeHtml(str string) htmlTemplate.HTML {return htmlTemplate.HTML(str)}
 func AnySlice(args ...any) (slice []any) {
 	for _,arg := range args {slice = append(slice, arg)}
 	return slice
 }
-func IncludePartial(partialName string)string{
-	var buf bytes.Buffer
-
-	if partial := partialTemplates[path.Join(getEnvValue("MD_TEMPLATES"), "partials", partialName)]; partial !=nil {
-		err := partial.Execute(&buf, map[string]any{})
-		if err!=nil{log.Println(err); return ""}
-
-	}else{log.Println("Partial does not exists:", partialName); return ""}
-
-	return buf.String()
-}
+// Execute the partial with the functions of the default tier.
+func IncludePartial(partialName string, data ...any) any { return defaultTier.IncludePartial(partialName, data...) }
 
 // text should be something like this: "tags=hello|||tags=test|||year=2025|||author=mandos"
 // First separate the items using the itemSepr, then, split the items into key-value pairs using keyValSepr.
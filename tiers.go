@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"; "database/sql"; "fmt"; htmlTemplate "html/template"; "io"; "log"; "sync"; "text/template"; "time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// A visibility tier of the index. Every tier has its own database, so the queries in the templates and the attachment
+// checks only see the nodes and the links the visitor is allowed to see.
+// The default tier is served to everyone. The member tier only exists if AUTH_USERS is given, and is served to the logged-in users.
+type Tier struct {
+	Full bool // If the tier contains the private nodes and the excluded lines.
+	DB *sql.DB
+
+	nodeCache *LRUCache[string, Node]
+	attachmentExistenceCache *TTLCache[string, struct{}]
+	queryCache *TTLCache[string, []map[string]any]
+
+	attExistStmt *sql.Stmt
+	aliasStmt *sql.Stmt
+	tombstoneStmt *sql.Stmt
+
+	funcs template.FuncMap // The template functions that are bound to the tier.
+	templates sync.Map // The templates cloned with the tier functions. key: template name, value: tierTemplate
+}
+
+var defaultTier, memberTier *Tier
+var tiers []*Tier
+
+func newTier(full bool) *Tier {
+	t := &Tier{
+		Full: full,
+		nodeCache: NewLRUCache[string, Node](500),
+		attachmentExistenceCache: NewTTLCache[string, struct{}](5 * time.Minute),
+		queryCache: NewTTLCache[string, []map[string]any](5 * time.Minute),
+	}
+	t.funcs = template.FuncMap{ "Query": t.Query, "GetNodeContent": t.GetNodeContent, "Include": t.IncludePartial, "TOC": t.TOC, "SuggestTitles": t.SuggestTitles }
+	return t
+}
+
+// The full tiers also serve the private nodes. The nodes outside their publishing window are not served in any tier.
+func (t *Tier) IsServed(node *Node) bool {return (t.Full || node.Public) && node.IsLive(time.Now().Unix())}
+
+// The database file of the tier. The same database is used by the full tiers, so switching ONLY_PUBLIC does not regenerate it.
+func (t *Tier) dbFile() string {
+	if t.Full {return "mandos-full.db"}
+	return "mandos.db"
+}
+
+// Get the tier of the request. The logged-in users get the member tier.
+func getTier(c *fiber.Ctx) *Tier {
+	if t, ok := c.Locals("tier").(*Tier); ok {return t}
+	return defaultTier
+}
+
+// A template cloned with the tier functions, and the template it is cloned from. If the template is reloaded, it is cloned again.
+type tierTemplate struct { original, clone Template }
+
+// Get the template with the functions of the tier. The default tier uses the template as is.
+func (t *Tier) Template(templ Template) Template {
+	if t == defaultTier || templ == nil {return templ}
+	if cached, ok := t.templates.Load(templ.Name()); ok && cached.(tierTemplate).original == templ {return cached.(tierTemplate).clone}
+
+	var clone Template
+	var err error
+	switch v := templ.(type) {
+	case *template.Template:
+		var textClone *template.Template
+		if textClone, err = v.Clone(); err == nil { clone = textClone.Funcs(t.funcs) }
+	case *htmlTemplate.Template:
+		var htmlClone *htmlTemplate.Template
+		if htmlClone, err = v.Clone(); err == nil { clone = htmlClone.Funcs(t.funcs) }
+	}
+	// Never fall back to the template of the default tier, its functions would give the wrong results.
+	if err != nil || clone == nil {log.Println("Template could not be cloned:", templ.Name(), err); return failedTemplate{templ.Name()}}
+
+	t.templates.Store(templ.Name(), tierTemplate{original: templ, clone: clone})
+	return clone
+}
+
+// A template that always fails, used if a template could not be prepared for a tier.
+type failedTemplate struct { name string }
+func (f failedTemplate) Execute(wr io.Writer, data any) error {return fmt.Errorf("template %s is not available", f.name)}
+func (f failedTemplate) Name() string {return f.name}
+
+// Execute the partial in the templates/partials folder with the tier functions. The partial gets the data as its dot,
+// which is the dot of the caller if it is not given.
+// Only the output of the HTML partials is safe HTML. The others are returned as strings, so the HTML templates escape them.
+func (t *Tier) IncludePartial(partialName string, data ...any) any {
+	var buf bytes.Buffer
+	relPath := getPartialPath(partialName)
+
+	if partial := partialTemplates[relPath]; partial != nil {
+		if err := partialErrors[relPath]; err != nil {log.Println("Partial cannot be included:", relPath, err); return ""}
+		if len(data) > 1 {log.Println("Include takes a partial name and its data:", partialName); return ""}
+
+		var dot any = map[string]any{}
+		if len(data) == 1 { dot = data[0] }
+		err := t.Template(partial).Execute(&buf, dot)
+		if err!=nil{log.Println(err); return ""}
+
+	}else{log.Println("Partial does not exists:", partialName); return ""}
+
+	if isHtmlTemplate(relPath) {return htmlTemplate.HTML(buf.String())}
+	return buf.String()
+}
+
+// Get the content of the node as the tier sees it.
+func (t *Tier) GetNodeContent(relPath string) string {
+	// Prefer cache.
+	nodeinfo, exists := t.nodeCache.Get(relPath)
+	if !exists {
+		var err error
+		nodeinfo, err = getNodeInfo(relPath, t.Full, true)
+		if err != nil {return err.Error()}
+		t.nodeCache.Put(relPath, nodeinfo) // Cache the node to the memory.
+	}
+	return nodeinfo.Content
+}
@@ -0,0 +1,37 @@
+package main
+
+import "log"
+
+// An entry in the table of contents. The headings under it with higher levels are its children.
+type TocEntry struct {
+	Level int
+	Text string
+	ID string
+	Children []*TocEntry
+}
+
+// Get the table of contents of the node in the default tier.
+func TOC(relPath string, levels ...int) []*TocEntry { return defaultTier.TOC(relPath, levels...) }
+
+// Get the headings of the node as a tree. If the levels are given as [min] or [min, max], only the headings in that range are used.
+// The headings come from the database of the tier, so the ones in the excluded lines are not listed.
+func (t *Tier) TOC(relPath string, levels ...int) (toc []*TocEntry) {
+	minLevel, maxLevel := 1, 6
+	if len(levels) > 0 { minLevel = levels[0] }
+	if len(levels) > 1 { maxLevel = levels[1] }
+
+	rows, err := t.DB.Query(`SELECT level, text, anchor FROM headings WHERE file = ? AND level BETWEEN ? AND ? ORDER BY position`, relPath, minLevel, maxLevel)
+	if err != nil {log.Println("TOC error:", relPath, err); return nil}
+	defer rows.Close()
+
+	// The last entry of every depth. A heading is added to the last entry with a lower level.
+	var stack []*TocEntry
+	for rows.Next() {
+		entry := &TocEntry{}
+		if err := rows.Scan(&entry.Level, &entry.Text, &entry.ID); err != nil {log.Println("TOC error:", relPath, err); return toc}
+		for len(stack) > 0 && stack[len(stack)-1].Level >= entry.Level { stack = stack[:len(stack)-1] }
+		if len(stack) == 0 { toc = append(toc, entry) } else { parent := stack[len(stack)-1]; parent.Children = append(parent.Children, entry) }
+		stack = append(stack, entry)
+	}
+	return toc
+}
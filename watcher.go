@@ -47,6 +47,15 @@ func watchFileChanges() {
 			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove) != 0 &&
 			!strings.HasPrefix(filepath.Base(event.Name),"."){
 				relPath := strings.TrimPrefix(event.Name, notesPath)
+
+				// Keep the wikilink targets up to date.
+				if event.Has(fsnotify.Remove) { wikiLinks.RemoveFile(relPath)
+				} else if info, err := os.Stat(event.Name); event.Has(fsnotify.Create) && err == nil && !info.IsDir() {
+					wikiLinks.AddFile(relPath)
+					// A new attachment can be the target of an unresolved wikilink.
+					if !strings.HasSuffix(event.Name, ".md") { scheduleLoad(event.Name, retryUnresolvedWikiLinks) }
+				}
+
 				// If the file was a markdown note
 				if strings.HasSuffix(event.Name, ".md") {
 
@@ -61,9 +70,17 @@ func watchFileChanges() {
 							if err!=nil{log.Println(event.Name, err); return}
 							upsertNodes(map[string]int64{relPath: fileInfo.ModTime().Unix()})
 							log.Println("A node has been updated: ",relPath)
+							retryUnresolvedWikiLinks()
 						})
 					}
 
+				// If the file was the redirect rules.
+				}else if relPath == getRedirectsPath() {
+					scheduleLoad(event.Name, func(){
+						loadRedirects()
+						log.Println("The redirect rules have been reloaded: ",relPath)
+					})
+
 				// If the file was in the templates folder of mandos.
 				}else if mdTemplates[relPath] != nil{
 					scheduleLoad(event.Name,func(){
@@ -71,8 +88,12 @@ func watchFileChanges() {
 						log.Println("A markdown template has been reloaded: ",relPath)
 					})
 
-				}else if partialTemplates[relPath] != nil{
+				// New partials can be created in the partials folder and its subfolders.
+				}else if partialTemplates[relPath] != nil || (isPartialPath(relPath) && event.Has(fsnotify.Create)) {
 					scheduleLoad(event.Name,func(){
+						info, err := os.Stat(event.Name)
+						if err != nil {delete(partialTemplates, relPath); checkPartials(); return}
+						if info.IsDir() {return}
 						loadTemplate(relPath,"partial")
 						log.Println("A partial template has been reloaded: ",relPath)
 					})
@@ -82,6 +103,15 @@ func watchFileChanges() {
 						loadTemplate(relPath,"solo")
 						log.Println("A solo template has been reloaded: ",relPath)
 					})
+				
+				// A new template in the templates folder can be a layout, like baseof.html.
+				}else if isMdTemplatePath(relPath) && event.Has(fsnotify.Create) {
+					scheduleLoad(event.Name,func(){
+						info, err := os.Stat(event.Name)
+						if err != nil || info.IsDir() || mdTemplates[relPath] != nil {return}
+						loadTemplate(relPath,"md")
+						log.Println("A markdown template has been loaded: ",relPath)
+					})
 				}
 
 				// If a new directory is created, watch it
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"; "log"; "os"; "path"; "strings"; "sync"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// Index of the files in MD_FOLDER, used to resolve the wikilinks like Obsidian does.
+type WikiIndex struct {
+	mu sync.RWMutex
+	byName map[string][]string // Lowercase file name -> files with that name.
+	titles map[string]string // Lowercase title of the served nodes -> file.
+	fileTitles map[string]string // File -> title. Used to remove the old titles.
+	unresolved map[string]struct{} // Nodes that contain wikilinks that could not be resolved.
+	// Increased when a file or title is added. The unresolved wikilinks are only retried if it has changed.
+	version, retriedVersion int
+}
+
+var wikiLinks = &WikiIndex{
+	byName: make(map[string][]string), titles: make(map[string]string),
+	fileTitles: make(map[string]string), unresolved: make(map[string]struct{}),
+}
+
+func (w *WikiIndex) AddFile(file string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	name := strings.ToLower(path.Base(file))
+	for _,f := range w.byName[name] { if f == file {return} }
+	w.byName[name] = append(w.byName[name], file)
+	w.version++
+}
+
+func (w *WikiIndex) RemoveFile(file string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	name := strings.ToLower(path.Base(file))
+	files := w.byName[name]
+	for i,f := range files {
+		if f == file { w.byName[name] = append(files[:i], files[i+1:]...); break }
+	}
+	if len(w.byName[name]) == 0 { delete(w.byName, name) }
+	w.setTitle(file, "")
+	delete(w.unresolved, file)
+}
+
+// Set the title of a served node. An empty title removes it.
+func (w *WikiIndex) SetTitle(file, title string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.setTitle(file, title)
+}
+func (w *WikiIndex) setTitle(file, title string) {
+	// Nodes without a title use their file path as title. They can already be resolved by their file name.
+	if title == file { title = "" }
+	old := w.fileTitles[file]
+	if old == title {return}
+
+	if old != "" && w.titles[strings.ToLower(old)] == file { delete(w.titles, strings.ToLower(old)) }
+	if title == "" { delete(w.fileTitles, file); return }
+
+	w.fileTitles[file] = title
+	// If more than one node has the same title, the first one is kept.
+	if _,exists := w.titles[strings.ToLower(title)]; !exists { w.titles[strings.ToLower(title)] = file; w.version++ }
+}
+
+// Resolve the wikilink target to a file. The target can be a file name, a path suffix or a path from the root, with or without
+// the .md extension. If more than one file matches, the one with the shortest path is used. If no file matches, the titles are checked.
+func (w *WikiIndex) Resolve(target string) (file string, ok bool) {
+	target = strings.TrimSpace(target)
+	if target == "" {return "", false}
+
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	lowerTarget := strings.ToLower(strings.TrimPrefix(target, "/"))
+	for _,name := range []string{lowerTarget, lowerTarget+".md"} {
+		for _,f := range w.byName[path.Base(name)] {
+			lowerFile := strings.ToLower(f)
+			// The path from the root always wins.
+			if lowerFile == "/"+name {return f, true}
+			if !strings.HasSuffix(lowerFile, "/"+name) {continue}
+
+			if file == "" || strings.Count(f, "/") < strings.Count(file, "/") ||
+			(strings.Count(f, "/") == strings.Count(file, "/") && f < file) { file = f }
+		}
+		if file != "" {return file, true}
+	}
+
+	file, ok = w.titles[strings.ToLower(target)]
+	return file, ok
+}
+
+// Remember if the node has unresolved wikilinks, so it can be reindexed when new files or titles are added.
+func (w *WikiIndex) SetUnresolved(file string, unresolved bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if unresolved { w.unresolved[file] = struct{}{} } else { delete(w.unresolved, file) }
+}
+
+// Get and clear the nodes with unresolved wikilinks, if a file or title is added since the last call.
+func (w *WikiIndex) TakeRetries() (files []string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.version == w.retriedVersion {return nil}
+	w.retriedVersion = w.version
+
+	for file := range w.unresolved { files = append(files, file) }
+	clear(w.unresolved)
+	return files
+}
+
+// Reindex the nodes whose wikilinks could not be resolved before. Their targets may exist now.
+func retryUnresolvedWikiLinks() {
+	nodes := make(map[string]int64)
+	for _,file := range wikiLinks.TakeRetries() {
+		fileInfo, err := os.Stat(SafeJoin(notesPath, file))
+		if err != nil {continue}
+		nodes[file] = fileInfo.ModTime().Unix()
+	}
+	if count := upsertNodes(nodes); count > 0 { log.Println(count, "node(s) with unresolved wikilinks are reindexed.") }
+}
+
+/////////////////////////////////////// GOLDMARK EXTENSION ///////////////////////////////////////
+
+var KindWikiLink = ast.NewNodeKind("WikiLink")
+
+type WikiLink struct {
+	ast.BaseInline
+	Target []byte // The file name, path or title.
+	Fragment []byte // The heading after #, if given.
+	Label []byte // The alias after |, or the link text itself.
+	Embed bool // If the link starts with !
+}
+
+func (n *WikiLink) Kind() ast.NodeKind {return KindWikiLink}
+func (n *WikiLink) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"Target": string(n.Target), "Fragment": string(n.Fragment)}, nil)
+}
+
+type wikiLinkParser struct{}
+
+func (p wikiLinkParser) Trigger() []byte {return []byte{'!', '['}}
+func (p wikiLinkParser) Parse(parent ast.Node, block text.Reader, pc parser.Context) ast.Node {
+	line, _ := block.PeekLine()
+	link := &WikiLink{Embed: bytes.HasPrefix(line, []byte("!"))}
+	if link.Embed { line = line[1:] }
+	if !bytes.HasPrefix(line, []byte("[[")) {return nil}
+
+	end := bytes.Index(line, []byte("]]"))
+	if end < 0 {return nil}
+	inner := line[2:end]
+	if bytes.ContainsAny(inner, "[]") {return nil}
+
+	link.Label = inner
+	if i := bytes.IndexByte(inner, '|'); i >= 0 { link.Label = inner[i+1:]; inner = inner[:i] }
+	if i := bytes.IndexByte(inner, '#'); i >= 0 { link.Fragment = bytes.TrimSpace(inner[i+1:]); inner = inner[:i] }
+	link.Target = bytes.TrimSpace(inner)
+	if len(link.Target) == 0 && len(link.Fragment) == 0 {return nil}
+
+	consumed := end+2
+	if link.Embed { consumed++ }
+	block.Advance(consumed)
+	return link
+}
+
+var imageExts = map[string]bool{".png":true, ".jpg":true, ".jpeg":true, ".gif":true, ".webp":true, ".svg":true, ".avif":true, ".bmp":true}
+
+type wikiLinkRenderer struct{}
+
+func (r wikiLinkRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) { reg.Register(KindWikiLink, r.render) }
+func (r wikiLinkRenderer) render(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {return ast.WalkContinue, nil}
+	n := node.(*WikiLink)
+
+	// [[#Heading]] links to a heading in the same node.
+	href, resolved := "", true
+	if len(n.Target) != 0 {
+		href, resolved = wikiLinks.Resolve(string(n.Target))
+		if !resolved {
+			href = "/"+strings.TrimPrefix(string(n.Target), "/")
+			if path.Ext(href) == "" { href += ".md" }
+		}
+		href = PrettyUrl(href)
+	}
+	if len(n.Fragment) != 0 { href += "#"+string(Slugify(n.Fragment, '-')) }
+	href = string(util.EscapeHTML(util.URLEscape([]byte(href), true)))
+
+	if n.Embed && resolved && imageExts[strings.ToLower(path.Ext(href))] {
+		w.WriteString(`<img src="`+href+`" alt="`); w.Write(util.EscapeHTML(n.Label)); w.WriteString(`" />`)
+		return ast.WalkSkipChildren, nil
+	}
+
+	class := "wikilink"
+	if !resolved { class += " wikilink-unresolved" }
+	w.WriteString(`<a href="`+href+`" class="`+class+`">`); w.Write(util.EscapeHTML(n.Label)); w.WriteString(`</a>`)
+	return ast.WalkSkipChildren, nil
+}
+
+type wikiLinkExtension struct{}
+
+// WikiLinks renders the wikilinks as anchors. The unresolved ones have the "wikilink-unresolved" class.
+var WikiLinks = &wikiLinkExtension{}
+
+func (e *wikiLinkExtension) Extend(m goldmark.Markdown) {
+	// Run before the link parser, which also triggers on [ and !
+	m.Parser().AddOptions(parser.WithInlineParsers(util.Prioritized(wikiLinkParser{}, 199)))
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(util.Prioritized(wikiLinkRenderer{}, 199)))
+}